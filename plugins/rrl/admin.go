@@ -0,0 +1,211 @@
+package rrl
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/rrl/plugins/rrl/cache"
+	"github.com/miekg/dns"
+)
+
+// admin serves a local HTTP endpoint for inspecting and resetting accounts in the rrl table
+type admin struct {
+	addr string
+	rrl  *RRL
+
+	srv *http.Server
+}
+
+// accountInfo is the decoded form of an account returned by the admin endpoint
+type accountInfo struct {
+	Token   string  `json:"token"`
+	Prefix  string  `json:"prefix"`
+	Type    string  `json:"type"`
+	Qtype   string  `json:"qtype,omitempty"`
+	Name    string  `json:"name,omitempty"` // hexadecimal hash of the name, unless listed by name
+	Balance float64 `json:"balance"`        // seconds of credit, negative when indebted
+}
+
+// rtypeStrings maps account types to names used in the admin endpoint
+var rtypeStrings = map[uint8]string{
+	rTypeResponse:      "response",
+	rTypeNodata:        "nodata",
+	rTypeNxdomain:      "nxdomain",
+	rTypeReferral:      "referral",
+	rTypeError:         "error",
+	rTypeAll:           "all",
+	rTypeAmplification: "amplification",
+	rTypeRequest:       "request",
+}
+
+// start listens on the admin address and serves requests in the background
+func (a *admin) start() error {
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/accounts", a.serveAccounts)
+	srv := &http.Server{Handler: mux, ReadTimeout: 5 * time.Second, WriteTimeout: 10 * time.Second}
+	a.srv = srv
+	go func() { srv.Serve(ln) }()
+	return nil
+}
+
+// stop stops serving requests
+func (a *admin) stop() error {
+	if a.srv == nil {
+		return nil
+	}
+	err := a.srv.Close()
+	a.srv = nil
+	return err
+}
+
+// serveAccounts handles requests to /accounts
+//
+//	GET /accounts?top=N          lists the N most indebted accounts (default 10)
+//	GET /accounts?client=IP      lists the accounts of the client's prefix
+//	GET /accounts?name=NAME      lists the accounts of NAME, which may be combined with client
+//	DELETE /accounts?token=T     deletes the account with token T
+//	DELETE /accounts?client=IP   deletes all accounts of the client's prefix
+//	DELETE /accounts?prefix=P    deletes all accounts of prefix P, as shown in the accounts
+func (a *admin) serveAccounts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		client, name := q.Get("client"), q.Get("name")
+		if client != "" || name != "" {
+			var prefix [16]byte
+			if client != "" {
+				var ok bool
+				if prefix, ok = a.rrl.clientPrefix(client); !ok {
+					http.Error(w, "invalid client address", http.StatusBadRequest)
+					return
+				}
+			}
+			// names are only stored as hashes, so the accounts of name are those with its hash
+			if name != "" {
+				name = strings.ToLower(dns.Fqdn(name))
+			}
+			hash := hashName(name)
+			infos := a.rrl.accounts(func(t cache.Key) bool {
+				return (client == "" || t.Prefix == prefix) && (name == "" || t.Name == hash)
+			}, 0)
+			if name != "" {
+				for i := range infos {
+					infos[i].Name = name
+				}
+			}
+			writeJSON(w, infos)
+			return
+		}
+		top := 10
+		if s := q.Get("top"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid top", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+		writeJSON(w, a.rrl.accounts(nil, top))
+	case http.MethodDelete:
+		var n int
+		switch {
+		case q.Get("token") != "":
+			token, err := parseTokenString(q.Get("token"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, found := a.rrl.table.Get(token); found {
+				a.rrl.table.Remove(token)
+				n = 1
+			}
+		case q.Get("client") != "" || q.Get("prefix") != "":
+			var prefix [16]byte
+			if client := q.Get("client"); client != "" {
+				var ok bool
+				if prefix, ok = a.rrl.clientPrefix(client); !ok {
+					http.Error(w, "invalid client address", http.StatusBadRequest)
+					return
+				}
+			} else {
+				ip := net.ParseIP(q.Get("prefix"))
+				if ip == nil {
+					http.Error(w, "invalid prefix", http.StatusBadRequest)
+					return
+				}
+				copy(prefix[:], ip.To16())
+			}
+			n = a.rrl.table.RemoveFunc(func(t cache.Key, _ *ResponseAccount) bool {
+				return t.Prefix == prefix
+			})
+		default:
+			http.Error(w, "one of token, client or prefix is required", http.StatusBadRequest)
+			return
+		}
+		log.Infof("admin deleted %d accounts", n)
+		writeJSON(w, map[string]int{"deleted": n})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// clientPrefix returns the address prefix that accounts of the client ip are indexed under
+func (rrl *RRL) clientPrefix(ip string) ([16]byte, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return [16]byte{}, false
+	}
+	return rrl.prefix(addr), true
+}
+
+// accounts returns the decoded accounts for which match returns true (or all accounts if match is nil), most
+// indebted first.  If top is greater than zero, at most top accounts are returned.
+func (rrl *RRL) accounts(match func(cache.Key) bool, top int) []accountInfo {
+	now := time.Now().UnixNano()
+	infos := []accountInfo{}
+	rrl.table.Range(func(t cache.Key, ra *ResponseAccount) bool {
+		if match != nil && !match(t) {
+			return true
+		}
+		info := tokenInfo(t)
+		info.Balance = float64(now-atomic.LoadInt64(&ra.allowTime)) / second
+		infos = append(infos, info)
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Balance < infos[j].Balance })
+	if top > 0 && len(infos) > top {
+		infos = infos[:top]
+	}
+	return infos
+}
+
+// tokenInfo decodes a token
+func tokenInfo(t cache.Key) accountInfo {
+	info := accountInfo{Token: tokenString(t), Prefix: prefixString(t.Prefix), Type: strconv.Itoa(int(t.Type))}
+	if s, ok := rtypeStrings[t.Type]; ok {
+		info.Type = s
+	}
+	if t.Qtype != 0 {
+		info.Qtype = dns.Type(t.Qtype).String()
+	}
+	if t.Name != 0 {
+		info.Name = strconv.FormatUint(t.Name, 16)
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
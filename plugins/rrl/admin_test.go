@@ -0,0 +1,170 @@
+package rrl
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coredns/rrl/plugins/rrl/cache"
+	"github.com/miekg/dns"
+)
+
+func TestTokenInfo(t *testing.T) {
+	rrl := defaultRRL()
+	v4 := net.ParseIP("1.2.3.4")
+	v6 := net.ParseIP("2001:db8::1")
+	name := strconv.FormatUint(hashName("example.com."), 16)
+	tests := []struct {
+		token    cache.Key
+		expected accountInfo
+	}{
+		{
+			token:    rrl.buildToken(rTypeResponse, dns.TypeA, "example.com.", v4),
+			expected: accountInfo{Prefix: "1.2.3.0", Type: "response", Qtype: "A", Name: name},
+		},
+		{
+			token:    rrl.buildToken(rTypeNxdomain, dns.TypeA, "example.com.", v4),
+			expected: accountInfo{Prefix: "1.2.3.0", Type: "nxdomain", Name: name},
+		},
+		{
+			token:    rrl.buildToken(rTypeError, dns.TypeA, "example.com.", v6),
+			expected: accountInfo{Prefix: "2001:db8::", Type: "error"},
+		},
+		{
+			token:    rrl.buildToken(rTypeRequest, 0, "", v4),
+			expected: accountInfo{Prefix: "1.2.3.0", Type: "request"},
+		},
+	}
+	for _, c := range tests {
+		c.expected.Token = tokenString(c.token)
+		got := tokenInfo(c.token)
+		if got != c.expected {
+			t.Errorf("expected %+v, got %+v", c.expected, got)
+		}
+	}
+}
+
+func TestAdminAccounts(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.initTable()
+	a := &admin{rrl: &rrl}
+
+	now := time.Now().UnixNano()
+	rrl.table.Add(rrl.buildToken(rTypeResponse, dns.TypeA, "a.example.com.", net.ParseIP("1.2.3.4")), &ResponseAccount{allowTime: now + 5*second})
+	rrl.table.Add(rrl.buildToken(rTypeResponse, dns.TypeA, "b.example.com.", net.ParseIP("1.2.3.4")), &ResponseAccount{allowTime: now + 2*second})
+	rrl.table.Add(rrl.buildToken(rTypeRequest, 0, "", net.ParseIP("1.2.3.4")), &ResponseAccount{allowTime: now})
+	rrl.table.Add(rrl.buildToken(rTypeResponse, dns.TypeA, "a.example.com.", net.ParseIP("5.6.7.8")), &ResponseAccount{allowTime: now + 3*second})
+
+	// the most indebted accounts are listed first
+	var infos []accountInfo
+	w := httptest.NewRecorder()
+	a.serveAccounts(w, httptest.NewRequest(http.MethodGet, "/accounts?top=2", nil))
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected %v accounts, got %v", 2, len(infos))
+	}
+	if infos[0].Name != strconv.FormatUint(hashName("a.example.com."), 16) || infos[0].Prefix != "1.2.3.0" || infos[1].Prefix != "5.6.7.0" {
+		t.Errorf("unexpected accounts listed: %+v", infos)
+	}
+
+	// accounts of a single client
+	w = httptest.NewRecorder()
+	a.serveAccounts(w, httptest.NewRequest(http.MethodGet, "/accounts?client=1.2.3.99", nil))
+	json.NewDecoder(w.Body).Decode(&infos)
+	if len(infos) != 3 {
+		t.Errorf("expected %v accounts, got %v", 3, len(infos))
+	}
+
+	// accounts of a name, of any client or of a single client
+	for _, test := range []struct {
+		query    string
+		expected int
+	}{
+		{query: "name=a.example.com.", expected: 2},
+		{query: "name=A.Example.com", expected: 2},
+		{query: "name=a.example.com&client=5.6.7.8", expected: 1},
+		{query: "name=c.example.com", expected: 0},
+	} {
+		w = httptest.NewRecorder()
+		a.serveAccounts(w, httptest.NewRequest(http.MethodGet, "/accounts?"+test.query, nil))
+		infos = nil
+		json.NewDecoder(w.Body).Decode(&infos)
+		if len(infos) != test.expected {
+			t.Errorf("expected %v accounts for %v, got %v", test.expected, test.query, len(infos))
+		}
+		for _, info := range infos {
+			if info.Name != "a.example.com." {
+				t.Errorf("expected accounts listed by name to show the name, got %v", info.Name)
+			}
+		}
+	}
+
+	// delete a single token
+	w = httptest.NewRecorder()
+	a.serveAccounts(w, httptest.NewRequest(http.MethodDelete, "/accounts?token="+tokenString(rrl.buildToken(rTypeResponse, dns.TypeA, "a.example.com.", net.ParseIP("5.6.7.8"))), nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %v, got %v", http.StatusOK, w.Code)
+	}
+	if l := rrl.table.Len(); l != 3 {
+		t.Errorf("expected %v accounts remaining, got %v", 3, l)
+	}
+
+	// delete all accounts of a client's prefix
+	var deleted map[string]int
+	w = httptest.NewRecorder()
+	a.serveAccounts(w, httptest.NewRequest(http.MethodDelete, "/accounts?client=1.2.3.4", nil))
+	json.NewDecoder(w.Body).Decode(&deleted)
+	if deleted["deleted"] != 3 {
+		t.Errorf("expected %v accounts deleted, got %v", 3, deleted["deleted"])
+	}
+	if l := rrl.table.Len(); l != 0 {
+		t.Errorf("expected %v accounts remaining, got %v", 0, l)
+	}
+
+	// delete all accounts of a prefix
+	rrl.table.Add(rrl.buildToken(rTypeRequest, 0, "", net.ParseIP("5.6.7.8")), &ResponseAccount{allowTime: now})
+	w = httptest.NewRecorder()
+	a.serveAccounts(w, httptest.NewRequest(http.MethodDelete, "/accounts?prefix=5.6.7.0", nil))
+	json.NewDecoder(w.Body).Decode(&deleted)
+	if deleted["deleted"] != 1 {
+		t.Errorf("expected %v accounts deleted, got %v", 1, deleted["deleted"])
+	}
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/accounts?client=banana", nil),
+		httptest.NewRequest(http.MethodGet, "/accounts?top=-1", nil),
+		httptest.NewRequest(http.MethodDelete, "/accounts", nil),
+		httptest.NewRequest(http.MethodDelete, "/accounts?token=banana", nil),
+		httptest.NewRequest(http.MethodDelete, "/accounts?prefix=banana", nil),
+		httptest.NewRequest(http.MethodPost, "/accounts", nil),
+	} {
+		w = httptest.NewRecorder()
+		a.serveAccounts(w, r)
+		if w.Code == http.StatusOK {
+			t.Errorf("expected %v %v to fail", r.Method, r.URL)
+		}
+	}
+}
+
+func TestAdminStartStop(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.initTable()
+	a := &admin{addr: "127.0.0.1:0", rrl: &rrl}
+
+	if err := a.start(); err != nil {
+		t.Fatalf("expected no error starting, got: %v", err)
+	}
+	if err := a.stop(); err != nil {
+		t.Errorf("expected no error stopping, got: %v", err)
+	}
+	// stopping again is a no-op
+	if err := a.stop(); err != nil {
+		t.Errorf("expected no error stopping twice, got: %v", err)
+	}
+}
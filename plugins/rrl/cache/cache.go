@@ -1,87 +1,149 @@
 package cache
 
 import (
+	"container/list"
 	"errors"
-	"hash/fnv"
 	"sync"
+	"sync/atomic"
 )
 
-// Hash returns the FNV hash of what.
-func Hash(what []byte) uint64 {
-	h := fnv.New64()
-	h.Write(what)
-	return h.Sum64()
+// ErrShardFull is returned when an element cannot be added because its shard is full and no element is evictable.
+var ErrShardFull = errors.New("failed to add item, shard full")
+
+// Hasher is the constraint of cache keys. Hash selects the shard of a key, so it should be evenly distributed.
+type Hasher interface {
+	comparable
+	Hash() uint64
 }
 
-// Cache is cache with a customizable eviction policy.
-type Cache struct {
-	shards [numShards]*shard
+// Cache is cache with a customizable eviction policy, of elements of type V indexed by keys of type K. Each shard
+// keeps its elements in least recently used order, and evicts its least recently used element that is evictable.
+type Cache[K Hasher, V any] struct {
+	shards []*shard[K, V]
+	mask   uint64 // selects the shard of a key hash, the number of shards less one
 }
 
-type EvictFn func(interface{}) bool
+// EvictFn returns true if the element may be evicted.
+type EvictFn[V any] func(V) bool
 
-// evictAll will evict the first item in the shard - effectively a random eviction
+// evictAll will evict the least recently used item in the shard - plain LRU eviction
 // this is the default mode of eviction if not set with SetEvict()
-var evictAll = func(interface{}) bool { return true }
+func evictAll[V any](V) bool { return true }
 
 // shard is a cache with customizable eviction policy.
-type shard struct {
-	items     map[string]interface{}
+type shard[K Hasher, V any] struct {
+	items     map[K]*list.Element
+	lru       *list.List // of *entry, most recently used first
 	size      int
-	evictable EvictFn
+	evictable EvictFn[V]
+	evictions uint64
 
 	sync.RWMutex
 }
 
-// New returns a new cache.
-func New(size int) *Cache {
-	ssize := size / numShards
+// New returns a new cache with the default number of shards.
+func New[K Hasher, V any](size int) *Cache[K, V] {
+	return NewWithShards[K, V](size, DefaultShards)
+}
+
+// NewWithShards returns a new cache of size split across shards, each holding at least 4 elements. More shards
+// reduce lock contention, fewer shards let a small cache keep closer to its size. It panics if shards is not a
+// power of two.
+func NewWithShards[K Hasher, V any](size, shards int) *Cache[K, V] {
+	if shards <= 0 || shards&(shards-1) != 0 {
+		panic("cache: number of shards must be a power of two")
+	}
+	ssize := size / shards
 	if ssize < 4 {
 		ssize = 4
 	}
 
-	c := &Cache{}
+	c := &Cache[K, V]{
+		shards: make([]*shard[K, V], shards),
+		mask:   uint64(shards - 1),
+	}
 
 	// Initialize all the shards
-	for i := 0; i < numShards; i++ {
-		c.shards[i] = newShard(ssize)
+	for i := range c.shards {
+		c.shards[i] = newShard[K, V](ssize)
 	}
 	return c
 }
 
-func (c *Cache) SetEvict(e EvictFn) {
+// SetEvict sets the function that decides whether an element may be evicted.
+func (c *Cache[K, V]) SetEvict(e EvictFn[V]) {
 	for _, s := range c.shards {
 		s.evictable = e
 	}
 }
 
-func keyShard(key string) uint64 {
-	return Hash([]byte(key)) & (numShards - 1)
+// shard returns the shard of key
+func (c *Cache[K, V]) shard(key K) *shard[K, V] {
+	return c.shards[key.Hash()&c.mask]
 }
 
 // Add adds a new element to the cache. If the element already exists it is overwritten.
-func (c *Cache) Add(key string, el interface{}) error {
-	return c.shards[keyShard(key)].Add(key, el)
+func (c *Cache[K, V]) Add(key K, el V) error {
+	return c.shard(key).Add(key, el)
 }
 
-func (c *Cache) UpdateAdd(key string, update func(interface{}) interface{}, add func() interface{}) interface{} {
-	return c.shards[keyShard(key)].UpdateAdd(key, update, add)
+// UpdateAdd replaces the element indexed under key with the result of update, or if key does not exist, adds the
+// result of add. It returns the element stored under key, or ErrShardFull if it could not be added.
+func (c *Cache[K, V]) UpdateAdd(key K, update func(V) V, add func() V) (V, error) {
+	return c.shard(key).UpdateAdd(key, update, add)
 }
 
 // Get looks up element index under key.
-func (c *Cache) Get(key string) (interface{}, bool) {
-	return c.shards[keyShard(key)].Get(key)
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	return c.shard(key).Get(key)
+}
+
+// Use looks up the element indexed under key and marks it as used, taking only a read lock, so that elements may
+// be used concurrently. Callers must synchronize any changes they make to the element.
+func (c *Cache[K, V]) Use(key K) (V, bool) {
+	return c.shard(key).Use(key)
 }
 
 // Remove removes the element indexed with key.
-func (c *Cache) Remove(key string) {
-	c.shards[keyShard(key)].Remove(key)
+func (c *Cache[K, V]) Remove(key K) {
+	c.shard(key).Remove(key)
+}
+
+// Range calls f for each element in the cache, one shard at a time, until f returns false.
+// Each shard is read locked while f is called for its elements, so f must not modify the cache.
+func (c *Cache[K, V]) Range(f func(key K, el V) bool) {
+	for _, s := range c.shards {
+		if !s.Range(f) {
+			return
+		}
+	}
+}
+
+// RemoveFunc removes every element for which f returns true, one shard at a time, and returns the number
+// of elements removed.
+func (c *Cache[K, V]) RemoveFunc(f func(key K, el V) bool) int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.RemoveFunc(f)
+	}
+	return n
+}
+
+// Expire removes the elements that are evictable from each shard, one shard at a time, and returns the number of
+// elements removed. Every element is checked, since an element that is not evictable may have been used less
+// recently than others that are.
+func (c *Cache[K, V]) Expire() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.Expire()
+	}
+	return n
 }
 
 // Len returns an estimate number of elements in the cache.
 // This is an estimate, because each shard is locked one at a time, and
 // items can be added/removed from other shards as each shard is counted.
-func (c *Cache) Len() int {
+func (c *Cache[K, V]) Len() int {
 	l := 0
 	for _, s := range c.shards {
 		l += s.Len()
@@ -89,86 +151,191 @@ func (c *Cache) Len() int {
 	return l
 }
 
+// Cap returns the most elements the cache can hold. Each shard holds an equal share of the size it was created with,
+// of at least 4 elements, so Cap may be more or less than that size.
+func (c *Cache[K, V]) Cap() int {
+	return len(c.shards) * c.shards[0].size
+}
+
+// Evictions returns the number of elements evicted from the cache to make room for new elements.
+func (c *Cache[K, V]) Evictions() uint64 {
+	n := uint64(0)
+	for _, s := range c.shards {
+		n += atomic.LoadUint64(&s.evictions)
+	}
+	return n
+}
+
+// entry is an element of a shard, indexed by key
+type entry[K Hasher, V any] struct {
+	key  K
+	el   V
+	used uint32 // set when the element is used under the read lock, until the element is moved to the front
+}
+
 // newShard returns a new shard with size.
-func newShard(size int) *shard {
-	return &shard{
-		items:     make(map[string]interface{}),
+func newShard[K Hasher, V any](size int) *shard[K, V] {
+	return &shard[K, V]{
+		items:     make(map[K]*list.Element),
+		lru:       list.New(),
 		size:      size,
-		evictable: evictAll,
+		evictable: evictAll[V],
 	}
 }
 
 // Add adds element indexed by key into the cache. Any existing element is overwritten
-func (s *shard) Add(key string, el interface{}) error {
+func (s *shard[K, V]) Add(key K, el V) error {
 	s.Lock()
+	defer s.Unlock()
+	if e, found := s.items[key]; found {
+		e.Value.(*entry[K, V]).el = el
+		s.moveToFront(e)
+		return nil
+	}
 	if s.len() >= s.size && !s.evict() {
-		s.Unlock()
-		return errors.New("failed to add item, shard full")
+		return ErrShardFull
 	}
-
-	s.items[key] = &el
-	s.Unlock()
+	s.items[key] = s.lru.PushFront(&entry[K, V]{key: key, el: el})
 	return nil
 }
 
 // Remove locks the shard and removes the element indexed by key from the cache.
-func (s *shard) Remove(key string) {
+func (s *shard[K, V]) Remove(key K) {
 	s.Lock()
 	s.remove(key)
 	s.Unlock()
 }
 
 // remove removes the element indexed by key from the cache.
-func (s *shard) remove(key string) {
-	delete(s.items, key)
+func (s *shard[K, V]) remove(key K) {
+	if e, found := s.items[key]; found {
+		s.lru.Remove(e)
+		delete(s.items, key)
+	}
+}
+
+// moveToFront moves e to the front of the least recently used list.
+func (s *shard[K, V]) moveToFront(e *list.Element) {
+	atomic.StoreUint32(&e.Value.(*entry[K, V]).used, 0)
+	s.lru.MoveToFront(e)
 }
 
-// evict removes the first evictable item from the shard.  If no items are evictable, return false.
-func (s *shard) evict() bool {
-	for key, item := range s.items {
-		if !s.evictable(item) {
-			continue
+// evictScan is the most items evict checks before giving up, so that inserting into a full shard of items that are
+// not evictable fails in constant time.
+const evictScan = 16
+
+// evict removes the least recently used item of the shard that is evictable, and returns false if none is found.
+// Items are checked from the back of the least recently used list, and those passed over are moved to the front:
+// items marked as used by Use (since moving them in Use would need the write lock), and items that are not
+// evictable, e.g. accounts deep in debt that have not been used since. At most evictScan items are checked, so an
+// evictable item behind more than that is found by a later eviction, which starts with the items behind those
+// passed over.
+func (s *shard[K, V]) evict() bool {
+	for i := min(evictScan, 2*s.lru.Len()); i > 0; i-- {
+		e := s.lru.Back()
+		ent := e.Value.(*entry[K, V])
+		if atomic.LoadUint32(&ent.used) == 0 && s.evictable(ent.el) {
+			s.remove(ent.key)
+			atomic.AddUint64(&s.evictions, 1)
+			return true
 		}
-		s.remove(key)
-		return true
+		s.moveToFront(e)
 	}
 	return false
 }
 
-// Get looks up the element indexed under key.
-func (s *shard) Get(key string) (interface{}, bool) {
+// Expire removes every element of the shard that is evictable, and returns the number of elements removed.
+func (s *shard[K, V]) Expire() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for e := s.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if ent := e.Value.(*entry[K, V]); s.evictable(ent.el) {
+			s.remove(ent.key)
+			n++
+		}
+		e = prev
+	}
+	return n
+}
+
+// Get looks up the element indexed under key. Getting an element does not count as using it.
+func (s *shard[K, V]) Get(key K) (V, bool) {
 	s.RLock()
-	el, found := s.items[key]
-	s.RUnlock()
-	if found {
-		return el, true
+	defer s.RUnlock()
+	if e, found := s.items[key]; found {
+		return e.Value.(*entry[K, V]).el, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Use looks up the element indexed under key, and marks it as used so that it is moved to the front of the
+// least recently used list before it can be evicted.
+func (s *shard[K, V]) Use(key K) (V, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if e, found := s.items[key]; found {
+		ent := e.Value.(*entry[K, V])
+		if atomic.LoadUint32(&ent.used) == 0 {
+			atomic.StoreUint32(&ent.used, 1)
+		}
+		return ent.el, true
 	}
-	return nil, false
+	var zero V
+	return zero, false
 }
 
-// UpdateAdd executes the function `update` on the element indexed under key.
+// UpdateAdd replaces the element indexed under key with the result of the function `update` on it.
 // If key does not exist, then it is added, with a value equal to the result of function `add`.
-func (s *shard) UpdateAdd(key string, update func(interface{}) interface{}, add func() interface{}) interface{} {
+// It returns the element stored under key.
+func (s *shard[K, V]) UpdateAdd(key K, update func(V) V, add func() V) (V, error) {
 	s.Lock()
 	defer s.Unlock()
-	el, found := s.items[key]
-	if found {
-		resp := update(el)
-		return resp
+	if e, found := s.items[key]; found {
+		s.moveToFront(e)
+		ent := e.Value.(*entry[K, V])
+		ent.el = update(ent.el)
+		return ent.el, nil
 	}
-	l := len(s.items)
-	if l >= s.size {
-		if !s.evict() {
-			return errors.New("failed to add item, shard full")
+	if s.len() >= s.size && !s.evict() {
+		var zero V
+		return zero, ErrShardFull
+	}
+	el := add()
+	s.items[key] = s.lru.PushFront(&entry[K, V]{key: key, el: el})
+	return el, nil
+}
+
+// Range calls f for each element in the shard until f returns false. It returns false if f did.
+func (s *shard[K, V]) Range(f func(key K, el V) bool) bool {
+	s.RLock()
+	defer s.RUnlock()
+	for key, e := range s.items {
+		if !f(key, e.Value.(*entry[K, V]).el) {
+			return false
 		}
 	}
-	newItem := add()
-	s.items[key] = newItem
-	return nil
+	return true
+}
+
+// RemoveFunc removes every element in the shard for which f returns true, and returns the number of elements removed.
+func (s *shard[K, V]) RemoveFunc(f func(key K, el V) bool) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for key, e := range s.items {
+		if f(key, e.Value.(*entry[K, V]).el) {
+			s.remove(key)
+			n++
+		}
+	}
+	return n
 }
 
 // Len returns the current length of the cache.
-func (s *shard) Len() int {
+func (s *shard[K, V]) Len() int {
 	s.RLock()
 	l := s.len()
 	s.RUnlock()
@@ -176,9 +343,10 @@ func (s *shard) Len() int {
 }
 
 // len returns the current length of the cache.
-func (s *shard) len() int {
+func (s *shard[K, V]) len() int {
 	l := len(s.items)
 	return l
 }
 
-const numShards = 256
+// DefaultShards is the number of shards of a cache returned by New.
+const DefaultShards = 256
@@ -1,92 +1,277 @@
 package cache
 
-import "testing"
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+)
 
 func TestCacheAddGetRemove(t *testing.T) {
-	c := New(4)
-	c.Add("1", 1)
+	c := New[Key, int](4)
+	c.Add(key("1"), 1)
 
-	if _, found := c.Get("1"); !found {
+	if _, found := c.Get(key("1")); !found {
 		t.Fatal("failed to find inserted record")
 	}
 
-	c.Remove("1")
+	c.Remove(key("1"))
 
-	if _, found := c.Get("1"); found {
+	if _, found := c.Get(key("1")); found {
 		t.Fatal("failed to remove inserted record")
 	}
 }
 
 func TestCacheUpdateAdd(t *testing.T) {
-	c := New(4)
+	c := New[Key, int](4)
 
-	updateFunc := func(el interface{}) interface{} {
-		iptr := el.(*int)
-		*iptr += 1
-		el = iptr
-		return iptr
-	}
+	updateFunc := func(i int) int { return i + 1 }
+	addFunc := func() int { return 1 }
 
-	addFunc := func() interface{} {
-		i := 1
-		return &i
+	// first call should insert value returned by add, and return it
+	i, err := c.UpdateAdd(key("a"), updateFunc, addFunc)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
 	}
-
-	// first call should insert value returned by add
-	el := c.UpdateAdd("a", updateFunc, addFunc)
-
-	el, found := c.Get("a")
+	if i != 1 {
+		t.Fatalf("expected to see return value of 1, got %v", i)
+	}
+	i, found := c.Get(key("a"))
 	if !found {
 		t.Fatal("failed to find inserted record")
 	}
-	i := *(el.(*int))
 	if i != 1 {
 		t.Fatalf("expected to see inital value of 1, got %v", i)
 	}
 
 	// second call should increment the value, and return it
-	el = c.UpdateAdd("a", updateFunc, addFunc)
-
-	i = *(el.(*int))
-
+	i, err = c.UpdateAdd(key("a"), updateFunc, addFunc)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
 	if i != 2 {
 		t.Fatalf("expected to see return value of 2, got %v", i)
 	}
-	el, found = c.Get("a")
+	i, found = c.Get(key("a"))
 	if !found {
 		t.Fatal("failed to find inserted record")
 	}
-	i = *(el.(*int))
 	if i != 2 {
 		t.Fatalf("expected to see value incremented to 2, got %v", i)
 	}
+
+	// updating in place through a pointer
+	pc := New[Key, *int](4)
+	pc.UpdateAdd(key("a"), nil, func() *int { i := 1; return &i })
+	pc.UpdateAdd(key("a"), func(p *int) *int { *p++; return p }, nil)
+	if p, _ := pc.Get(key("a")); *p != 2 {
+		t.Fatalf("expected to see value incremented to 2, got %v", *p)
+	}
 }
 
 func TestCacheLen(t *testing.T) {
-	c := New(4)
+	c := New[Key, int](4)
 
-	c.Add("1", 1)
+	c.Add(key("1"), 1)
 	if l := c.Len(); l != 1 {
 		t.Fatalf("cache size should %d, got %d", 1, l)
 	}
 
-	c.Add("1", 1)
+	c.Add(key("1"), 1)
 	if l := c.Len(); l != 1 {
 		t.Fatalf("cache size should %d, got %d", 1, l)
 	}
 
-	c.Add("2", 2)
+	c.Add(key("2"), 2)
 	if l := c.Len(); l != 2 {
 		t.Fatalf("cache size should %d, got %d", 2, l)
 	}
 }
 
+func TestCacheRange(t *testing.T) {
+	c := New[Key, int](1024)
+	for i := 0; i < 100; i++ {
+		c.Add(key(strconv.Itoa(i)), i)
+	}
+
+	seen := make(map[Key]int)
+	c.Range(func(k Key, el int) bool {
+		seen[k] = el
+		return true
+	})
+	if len(seen) != 100 {
+		t.Fatalf("expected to see %d elements, got %d", 100, len(seen))
+	}
+	for k, v := range seen {
+		if k != key(strconv.Itoa(v)) {
+			t.Fatalf("expected element %v under key %v, got %v", k, k, v)
+		}
+	}
+
+	// returning false stops the iteration
+	n := 0
+	c.Range(func(Key, int) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("expected iteration to stop after %d elements, got %d", 10, n)
+	}
+}
+
+func TestCacheRemoveFunc(t *testing.T) {
+	c := New[Key, int](1024)
+	for i := 0; i < 100; i++ {
+		c.Add(key(strconv.Itoa(i)), i)
+	}
+
+	n := c.RemoveFunc(func(_ Key, el int) bool {
+		return el%2 == 0
+	})
+	if n != 50 {
+		t.Fatalf("expected %d elements removed, got %d", 50, n)
+	}
+	if l := c.Len(); l != 50 {
+		t.Fatalf("cache size should %d, got %d", 50, l)
+	}
+	if _, found := c.Get(key("2")); found {
+		t.Fatal("found element that should have been removed")
+	}
+	if _, found := c.Get(key("3")); !found {
+		t.Fatal("failed to find element that should not have been removed")
+	}
+}
+
+func TestNewWithShards(t *testing.T) {
+	tests := []struct {
+		size, shards int
+		shardSize    int
+	}{
+		{size: 1000, shards: 1, shardSize: 1000},
+		{size: 1000, shards: 4, shardSize: 250},
+		{size: 10, shards: 4, shardSize: 4},
+		{size: 100000, shards: 1024, shardSize: 97},
+	}
+	for i, test := range tests {
+		c := NewWithShards[Key, int](test.size, test.shards)
+		if len(c.shards) != test.shards {
+			t.Errorf("Test %d: expected %d shards, got %d", i, test.shards, len(c.shards))
+		}
+		for _, s := range c.shards {
+			if s.size != test.shardSize {
+				t.Fatalf("Test %d: expected shard size %d, got %d", i, test.shardSize, s.size)
+			}
+		}
+		if capacity := c.Cap(); capacity != test.shards*test.shardSize {
+			t.Errorf("Test %d: expected capacity %d, got %d", i, test.shards*test.shardSize, capacity)
+		}
+		// every shard is used
+		for j := 0; j < test.shards*100; j++ {
+			c.Add(key(strconv.Itoa(j)), j)
+		}
+		for j, s := range c.shards {
+			if s.Len() == 0 {
+				t.Fatalf("Test %d: expected shard %d to be used", i, j)
+			}
+		}
+	}
+
+	for _, shards := range []int{0, 3, 100, -4} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for %d shards", shards)
+				}
+			}()
+			NewWithShards[Key, int](1000, shards)
+		}()
+	}
+}
+
 func BenchmarkCache(b *testing.B) {
 	b.ReportAllocs()
 
-	c := New(4)
+	c := New[Key, int](4)
 	for n := 0; n < b.N; n++ {
-		c.Add("1", 1)
-		c.Get("1")
+		c.Add(key("1"), 1)
+		c.Get(key("1"))
+	}
+}
+
+func TestCacheEvictions(t *testing.T) {
+	c := New[Key, int](1024)
+	for i := 0; i < 2000; i++ {
+		c.Add(key(strconv.Itoa(i)), i)
+	}
+	if e, l := c.Evictions(), c.Len(); e != uint64(2000-l) {
+		t.Fatalf("expected %d evictions, got %d", 2000-l, e)
+	}
+
+	// when nothing is evictable, adds fail once a shard is full
+	c = New[Key, int](1024)
+	c.SetEvict(func(int) bool { return false })
+	var err error
+	for i := 0; i < 2000 && err == nil; i++ {
+		err = c.Add(key(strconv.Itoa(i)), i)
+	}
+	if err != ErrShardFull {
+		t.Fatalf("expected %v, got %v", ErrShardFull, err)
+	}
+	if e := c.Evictions(); e != 0 {
+		t.Fatalf("expected no evictions, got %d", e)
+	}
+}
+
+func TestCacheExpire(t *testing.T) {
+	c := New[Key, int](1024)
+	// only even values are evictable
+	c.SetEvict(func(el int) bool { return el%2 == 0 })
+	for i := 0; i < 100; i++ {
+		c.Add(key(strconv.Itoa(i)), i*2)
+	}
+	for i := 100; i < 200; i++ {
+		c.Add(key(strconv.Itoa(i)), 1)
+	}
+
+	// the evictable elements are less recently used than the rest, so all of them are removed
+	if n := c.Expire(); n != 100 {
+		t.Fatalf("expected 100 elements to expire, got %d", n)
+	}
+	if l := c.Len(); l != 100 {
+		t.Fatalf("expected 100 elements to remain, got %d", l)
+	}
+	if e := c.Evictions(); e != 0 {
+		t.Fatalf("expected expired elements not to count as evictions, got %d", e)
+	}
+	if n := c.Expire(); n != 0 {
+		t.Fatalf("expected no elements to expire, got %d", n)
+	}
+}
+
+// BenchmarkCacheShards updates elements from several cores, to compare lock contention across numbers of shards
+func BenchmarkCacheShards(b *testing.B) {
+	keys := make([]Key, 10000)
+	for i := range keys {
+		keys[i] = key(strconv.Itoa(i))
+	}
+	update := func(i int) int { return i + 1 }
+	add := func() int { return 0 }
+	for _, shards := range []int{1, 16, 256, 4096} {
+		for _, procs := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("shards=%d/procs=%d", shards, procs), func(b *testing.B) {
+				c := NewWithShards[Key, int](len(keys), shards)
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := rand.Intn(len(keys))
+					for pb.Next() {
+						c.UpdateAdd(keys[i%len(keys)], update, add)
+						i++
+					}
+				})
+			})
+		}
 	}
 }
@@ -0,0 +1,35 @@
+package cache
+
+// Key is a fixed size binary key, identifying an account by client address prefix, type, query type and a hash
+// of the name. Keys are compared and hashed without allocating.
+type Key struct {
+	Prefix [16]byte // client address prefix, IPv4 prefixes in IPv4-mapped IPv6 form
+	Type   uint8
+	Qtype  uint16
+	Name   uint64 // hash of the name, 0 when not indexed by name
+}
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// Hash returns the FNV-1a hash of the key.
+func (k Key) Hash() uint64 {
+	h := uint64(offset64)
+	for _, b := range k.Prefix {
+		h ^= uint64(b)
+		h *= prime64
+	}
+	h ^= uint64(k.Type)
+	h *= prime64
+	h ^= uint64(k.Qtype)
+	h *= prime64
+	h ^= uint64(k.Qtype >> 8)
+	h *= prime64
+	for i := 0; i < 64; i += 8 {
+		h ^= (k.Name >> i) & 0xff
+		h *= prime64
+	}
+	return h
+}
@@ -0,0 +1,39 @@
+package cache
+
+import "testing"
+
+// key returns a key with a prefix of s, for tests
+func key(s string) Key {
+	var k Key
+	copy(k.Prefix[:], s)
+	return k
+}
+
+func TestKeyHash(t *testing.T) {
+	a := Key{Type: 1, Qtype: 28, Name: 12345}
+	a.Prefix[15] = 1
+	b := a
+	if a.Hash() != b.Hash() {
+		t.Fatal("expected equal keys to have equal hashes")
+	}
+
+	// every field contributes to the hash
+	for i, k := range []Key{
+		{Prefix: b.Prefix, Type: 2, Qtype: 28, Name: 12345},
+		{Prefix: b.Prefix, Type: 1, Qtype: 1, Name: 12345},
+		{Prefix: b.Prefix, Type: 1, Qtype: 28, Name: 12346},
+		{Type: 1, Qtype: 28, Name: 12345},
+	} {
+		if k.Hash() == a.Hash() {
+			t.Errorf("Test %d: expected different keys to have different hashes", i)
+		}
+	}
+}
+
+func BenchmarkKeyHash(b *testing.B) {
+	k := Key{Type: 1, Qtype: 28, Name: 12345}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		k.Hash()
+	}
+}
@@ -1,117 +1,268 @@
 package cache
 
-import "testing"
+import (
+	"strconv"
+	"testing"
+)
 
 func TestShardAddAndGet(t *testing.T) {
-	s := newShard(4)
-	s.Add("1", 1)
+	s := newShard[Key, int](4)
+	s.Add(key("1"), 1)
 
-	if _, found := s.Get("1"); !found {
+	if _, found := s.Get(key("1")); !found {
 		t.Fatal("Failed to find inserted record")
 	}
 }
 
 func TestShardLen(t *testing.T) {
-	s := newShard(4)
+	s := newShard[Key, int](4)
 
-	s.Add("1", 1)
+	s.Add(key("1"), 1)
 	if l := s.Len(); l != 1 {
 		t.Fatalf("Shard size should %d, got %d", 1, l)
 	}
 
-	s.Add("1", 1)
+	s.Add(key("1"), 1)
 	if l := s.Len(); l != 1 {
 		t.Fatalf("Shard size should %d, got %d", 1, l)
 	}
 
-	s.Add("2", 2)
+	s.Add(key("2"), 2)
 	if l := s.Len(); l != 2 {
 		t.Fatalf("Shard size should %d, got %d", 2, l)
 	}
 }
 
 func TestShardEvict(t *testing.T) {
-	s := newShard(1)
-	s.Add("1", 1)
-	s.Add("2", 2)
+	s := newShard[Key, int](1)
+	s.Add(key("1"), 1)
+	s.Add(key("2"), 2)
 	// 1 should be gone
 
-	if _, found := s.Get("1"); found {
+	if _, found := s.Get(key("1")); found {
 		t.Fatal("Found item that should have been evicted")
 	}
 }
 
 func TestShardLenEvict(t *testing.T) {
-	s := newShard(4)
-	s.Add("1", 1)
-	s.Add("2", 1)
-	s.Add("3", 1)
-	s.Add("4", 1)
+	s := newShard[Key, int](4)
+	s.Add(key("1"), 1)
+	s.Add(key("2"), 1)
+	s.Add(key("3"), 1)
+	s.Add(key("4"), 1)
 
 	if l := s.Len(); l != 4 {
 		t.Fatalf("Shard size should %d, got %d", 4, l)
 	}
 
 	// This should evict one element
-	s.Add("5", 1)
+	s.Add(key("5"), 1)
 	if l := s.Len(); l != 4 {
 		t.Fatalf("Shard size should %d, got %d", 4, l)
 	}
 }
 
 func TestShardUpdateAdd(t *testing.T) {
-	s := newShard(1)
+	s := newShard[Key, int](1)
 
-	updateFunc := func(el interface{}) interface{} {
-		iptr := el.(*int)
-		*iptr += 1
-		el = iptr
-		return iptr
-	}
-
-	addFunc := func() interface{} {
-		i := 1
-		return &i
-	}
+	updateFunc := func(i int) int { return i + 1 }
+	addFunc := func() int { return 1 }
 
 	// first call should insert value returned by add
-	el := s.UpdateAdd("a", updateFunc, addFunc)
+	s.UpdateAdd(key("a"), updateFunc, addFunc)
 
-	el, found := s.Get("a")
+	i, found := s.Get(key("a"))
 	if !found {
 		t.Fatal("failed to find inserted record")
 	}
-	i := el.(*int)
-	if *i != 1 {
-		t.Fatalf("expected to see inital value of 1, got %v", *i)
+	if i != 1 {
+		t.Fatalf("expected to see inital value of 1, got %v", i)
 	}
 
 	// second call should increment the value, and return it
-	el = s.UpdateAdd("a", updateFunc, addFunc)
-
-	i = el.(*int)
-
-	if *i != 2 {
+	i, _ = s.UpdateAdd(key("a"), updateFunc, addFunc)
+	if i != 2 {
 		t.Fatalf("expected to see return value of 2, got %v", i)
 	}
-	el, found = s.Get("a")
+	i, found = s.Get(key("a"))
 	if !found {
 		t.Fatal("failed to find inserted record")
 	}
-	i = el.(*int)
-	if *i != 2 {
+	if i != 2 {
 		t.Fatalf("expected to see value incremented to 2, got %v", i)
 	}
 
 	// Adding another key should evict the prior key
-	el = s.UpdateAdd("b", updateFunc, addFunc)
-	el, found = s.Get("a")
-	if found {
+	s.UpdateAdd(key("b"), updateFunc, addFunc)
+	if _, found = s.Get(key("a")); found {
 		t.Fatal("expected 'a' to be evicted, but found it")
 	}
-	el, found = s.Get("b")
-	if !found {
+	if _, found = s.Get(key("b")); !found {
 		t.Fatal("failed to find inserted record")
 	}
+}
+
+func TestShardEvictLRU(t *testing.T) {
+	s := newShard[Key, int](2)
+	s.Add(key("1"), 1)
+	s.Add(key("2"), 2)
+
+	// using 1 leaves 2 as the least recently used
+	s.UpdateAdd(key("1"), func(el int) int { return el }, func() int { return 1 })
+	s.Add(key("3"), 3)
+
+	if _, found := s.Get(key("2")); found {
+		t.Fatal("expected least recently used item to be evicted")
+	}
+	for _, k := range []Key{key("1"), key("3")} {
+		if _, found := s.Get(k); !found {
+			t.Fatalf("expected %v to remain", k)
+		}
+	}
+
+	// overwriting counts as using
+	s.Add(key("1"), 1)
+	s.Add(key("4"), 4)
+	if _, found := s.Get(key("3")); found {
+		t.Fatal("expected least recently used item to be evicted")
+	}
+}
+
+func TestShardUseEvict(t *testing.T) {
+	s := newShard[Key, int](2)
+	s.Add(key("1"), 1)
+	s.Add(key("2"), 2)
+
+	// using 1 leaves 2 as the least recently used, although 1 is only moved when it reaches the back
+	if el, found := s.Use(key("1")); !found || el != 1 {
+		t.Fatalf("expected to use 1, got %v", el)
+	}
+	s.Add(key("3"), 3)
+
+	if _, found := s.Get(key("2")); found {
+		t.Fatal("expected least recently used item to be evicted")
+	}
+	if _, found := s.Get(key("1")); !found {
+		t.Fatal("expected used item to remain")
+	}
+
+	// 1 is no longer marked as used once moved, so it is the next evicted
+	s.Add(key("4"), 4)
+	if _, found := s.Get(key("1")); found {
+		t.Fatal("expected least recently used item to be evicted")
+	}
+
+	if _, found := s.Use(key("5")); found {
+		t.Fatal("expected not to find missing item")
+	}
+}
+
+func TestShardEvictNotEvictable(t *testing.T) {
+	s := newShard[Key, int](2)
+	// only even values are evictable
+	s.evictable = func(el int) bool { return el%2 == 0 }
+	s.Add(key("1"), 1)
+	s.Add(key("3"), 3)
+
+	// no item is evictable, so the shard is full
+	if err := s.Add(key("5"), 5); err != ErrShardFull {
+		t.Fatalf("expected %v, got %v", ErrShardFull, err)
+	}
+	if _, err := s.UpdateAdd(key("5"), func(el int) int { return el }, func() int { return 5 }); err != ErrShardFull {
+		t.Fatalf("expected %v, got %v", ErrShardFull, err)
+	}
+	if e := s.evictions; e != 0 {
+		t.Fatalf("expected no evictions, got %d", e)
+	}
+}
+
+func TestShardEvictScanBounded(t *testing.T) {
+	const size = 4 * evictScan
+	s := newShard[Key, int](size)
+	// only even values are evictable, and the only one is behind more than evictScan items that are not
+	s.evictable = func(el int) bool { return el%2 == 0 }
+	for i := 0; i < size-1; i++ {
+		s.Add(key(strconv.Itoa(i)), 2*i+1)
+	}
+	s.Add(key("recovered"), 2)
+
+	// each failed insert checks at most evictScan items, and moves them to the front, so that a later insert
+	// reaches the evictable item
+	failed := 0
+	for s.Add(key("new"), 1) == ErrShardFull {
+		failed++
+		if failed > size/evictScan {
+			t.Fatalf("expected the evictable item to be found within %d inserts", size/evictScan)
+		}
+	}
+	if failed == 0 {
+		t.Error("expected the first inserts to fail")
+	}
+	if _, found := s.Get(key("recovered")); found {
+		t.Error("expected the evictable item to be evicted")
+	}
+}
+
+func TestShardEvictBehindNotEvictable(t *testing.T) {
+	s := newShard[Key, int](4)
+	// only even values are evictable, e.g. accounts that have recovered
+	s.evictable = func(el int) bool { return el%2 == 0 }
+
+	// the least recently used item is not evictable, e.g. an account deep in debt that has gone quiet, but the
+	// items used after it are
+	s.Add(key("indebted"), 1)
+	s.Add(key("2"), 2)
+	s.Add(key("4"), 4)
+	s.Add(key("6"), 6)
 
+	if err := s.Add(key("8"), 8); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, found := s.Get(key("2")); found {
+		t.Fatal("expected the least recently used evictable item to be evicted")
+	}
+	if _, found := s.Get(key("indebted")); !found {
+		t.Fatal("expected the item that is not evictable to remain")
+	}
+	if _, err := s.UpdateAdd(key("10"), func(el int) int { return el }, func() int { return 10 }); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, found := s.Get(key("4")); found {
+		t.Fatal("expected the least recently used evictable item to be evicted")
+	}
+}
+
+func TestShardExpireBehindNotEvictable(t *testing.T) {
+	s := newShard[Key, int](4)
+	s.evictable = func(el int) bool { return el%2 == 0 }
+	s.Add(key("indebted"), 1)
+	s.Add(key("2"), 2)
+	s.Add(key("4"), 4)
+	s.Add(key("6"), 6)
+
+	// the item at the back is not evictable, which doesn't stop the others from expiring
+	if n := s.Expire(); n != 3 {
+		t.Fatalf("expected 3 items to expire, got %d", n)
+	}
+	if _, found := s.Get(key("indebted")); !found || s.Len() != 1 {
+		t.Fatal("expected only the item that is not evictable to remain")
+	}
+}
+
+// BenchmarkShardAddFull adds to a full shard of items that are not evictable, which fails in the same time
+// whatever the size of the shard.
+func BenchmarkShardAddFull(b *testing.B) {
+	for _, size := range []int{100, 10000, 1000000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			s := newShard[Key, int](size)
+			s.evictable = func(int) bool { return false }
+			for i := 0; i < size; i++ {
+				s.Add(key(strconv.Itoa(i)), i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Add(key("new"), i)
+			}
+		})
+	}
 }
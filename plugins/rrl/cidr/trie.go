@@ -0,0 +1,129 @@
+// Package cidr provides a binary prefix trie for matching IP addresses against a set of networks.
+package cidr
+
+import (
+	"net"
+)
+
+// Trie is a set of IP networks stored as a binary prefix trie. Lookups walk at most one node
+// per address bit, so the cost of Contains does not depend on the number of networks in the set.
+// A Trie is not safe for concurrent modification, but may be read concurrently once built.
+type Trie struct {
+	v4  *node
+	v6  *node
+	len int
+}
+
+// node is a single bit position in the trie.
+type node struct {
+	child [2]*node
+	term  bool // a network ends at this node, all addresses below it are contained
+}
+
+// New returns an empty trie.
+func New() *Trie {
+	return &Trie{v4: &node{}, v6: &node{}}
+}
+
+// Parse parses a CIDR, or a single IP address, into a network. A single address is
+// treated as a /32 (ipv4) or /128 (ipv6) network.
+func Parse(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Insert adds the network n to the trie.
+func (t *Trie) Insert(n *net.IPNet) {
+	ip, root := t.root(n.IP)
+	if ip == nil {
+		return
+	}
+	ones, bits := n.Mask.Size()
+	if bits == 8*net.IPv6len && len(ip) == net.IPv4len {
+		// ipv4-mapped ipv6 network, e.g. ::ffff:10.0.0.0/104
+		ones -= 8 * (net.IPv6len - net.IPv4len)
+		if ones < 0 {
+			ones = 0
+		}
+	}
+	nd := root
+	for i := 0; i < ones; i++ {
+		if nd.term {
+			// a shorter prefix already contains this network
+			return
+		}
+		b := bit(ip, i)
+		if nd.child[b] == nil {
+			nd.child[b] = &node{}
+		}
+		nd = nd.child[b]
+	}
+	if nd.term {
+		return
+	}
+	// any longer prefixes below this node are now redundant
+	t.len -= nd.child[0].count() + nd.child[1].count()
+	nd.child = [2]*node{}
+	nd.term = true
+	t.len++
+}
+
+// Contains returns true if ip is within any network in the trie.
+func (t *Trie) Contains(ip net.IP) bool {
+	ip, nd := t.root(ip)
+	if ip == nil {
+		return false
+	}
+	for i := 0; nd != nil; i++ {
+		if nd.term {
+			return true
+		}
+		if i == len(ip)*8 {
+			return false
+		}
+		nd = nd.child[bit(ip, i)]
+	}
+	return false
+}
+
+// Len returns the number of networks in the trie, not counting networks that were
+// inserted within a network already present.
+func (t *Trie) Len() int {
+	return t.len
+}
+
+// root returns the normalized address and the root node of its address family.
+func (t *Trie) root(ip net.IP) (net.IP, *node) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, t.v4
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16, t.v6
+	}
+	return nil, nil
+}
+
+// count returns the number of networks ending at or below nd.
+func (nd *node) count() int {
+	if nd == nil {
+		return 0
+	}
+	if nd.term {
+		return 1
+	}
+	return nd.child[0].count() + nd.child[1].count()
+}
+
+// bit returns the i-th most significant bit of ip.
+func bit(ip net.IP, i int) byte {
+	return (ip[i/8] >> (7 - uint(i%8))) & 1
+}
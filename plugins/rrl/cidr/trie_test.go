@@ -0,0 +1,116 @@
+package cidr
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestTrieContains(t *testing.T) {
+	tr := New()
+	for _, s := range []string{"10.0.0.0/8", "192.168.1.0/24", "203.0.113.7", "2001:db8::/32", "::1"} {
+		n, err := Parse(s)
+		if err != nil {
+			t.Fatalf("failed to parse %v: %v", s, err)
+		}
+		tr.Insert(n)
+	}
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"192.168.1.200", true},
+		{"192.168.2.1", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"2001:db8:1::53", true},
+		{"2001:db9::53", false},
+		{"::1", true},
+		{"::2", false},
+		{"::ffff:10.0.0.1", true},
+	}
+	for _, c := range tests {
+		got := tr.Contains(net.ParseIP(c.ip))
+		if got != c.expected {
+			t.Errorf("expected Contains(%v) to be %v, got %v", c.ip, c.expected, got)
+		}
+	}
+}
+
+func TestTrieLen(t *testing.T) {
+	tr := New()
+	for _, s := range []string{"10.1.0.0/16", "10.0.0.0/8", "10.2.0.0/16", "10.0.0.0/8", "2001:db8::/32"} {
+		n, _ := Parse(s)
+		tr.Insert(n)
+	}
+	// 10.1.0.0/16 is replaced by 10.0.0.0/8, 10.2.0.0/16 and the duplicate are redundant
+	if l := tr.Len(); l != 2 {
+		t.Errorf("expected trie length %v, got %v", 2, l)
+	}
+	if !tr.Contains(net.ParseIP("10.3.0.1")) {
+		t.Errorf("expected 10.3.0.1 to be contained")
+	}
+}
+
+func TestTrieEmpty(t *testing.T) {
+	tr := New()
+	if tr.Contains(net.ParseIP("1.2.3.4")) {
+		t.Errorf("expected empty trie to contain nothing")
+	}
+	n, _ := Parse("0.0.0.0/0")
+	tr.Insert(n)
+	if !tr.Contains(net.ParseIP("1.2.3.4")) {
+		t.Errorf("expected 0.0.0.0/0 to contain 1.2.3.4")
+	}
+	if tr.Contains(net.ParseIP("2001:db8::1")) {
+		t.Errorf("expected 0.0.0.0/0 not to contain ipv6 addresses")
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  string
+		shouldErr bool
+	}{
+		{input: "10.0.0.0/8", expected: "10.0.0.0/8"},
+		{input: "10.1.2.3/8", expected: "10.0.0.0/8"},
+		{input: "10.1.2.3", expected: "10.1.2.3/32"},
+		{input: "2001:db8::1", expected: "2001:db8::1/128"},
+		{input: "10.1.2.3/33", shouldErr: true},
+		{input: "banana", shouldErr: true},
+	}
+	for _, c := range tests {
+		n, err := Parse(c.input)
+		if c.shouldErr {
+			if err == nil {
+				t.Errorf("expected error parsing %v", c.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected no error parsing %v, got %v", c.input, err)
+			continue
+		}
+		if n.String() != c.expected {
+			t.Errorf("expected %v, got %v", c.expected, n.String())
+		}
+	}
+}
+
+func BenchmarkTrieContains(b *testing.B) {
+	tr := New()
+	for i := 0; i < 4096; i++ {
+		_, n, _ := net.ParseCIDR("10." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256) + ".0/24")
+		tr.Insert(n)
+	}
+	ip := net.ParseIP("10.15.255.1")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Contains(ip)
+	}
+}
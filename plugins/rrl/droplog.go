@@ -0,0 +1,104 @@
+package rrl
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/coredns/coredns/request"
+	"github.com/coredns/rrl/plugins/rrl/cache"
+	"github.com/miekg/dns"
+)
+
+// Actions taken on a response that exceeded a limit
+const (
+	actionDrop   = "drop"
+	actionSlip   = "slip"
+	actionReport = "report" // report-only, the response was sent
+)
+
+// dropEvent is a record of a request or response that exceeded a limit
+type dropEvent struct {
+	Client  string  `json:"client"`
+	Token   string  `json:"token"`
+	Qname   string  `json:"qname"`
+	Qtype   string  `json:"qtype"`
+	Rtype   string  `json:"rtype"`
+	Rcode   string  `json:"rcode,omitempty"`
+	Balance float64 `json:"balance"` // in units of the allowance, i.e. the number of responses owed
+	Action  string  `json:"action"`
+}
+
+// dropLogger writes a structured record of every sampled drop event to the log
+type dropLogger struct {
+	json   bool
+	sample uint64 // log one of every sample events
+	count  uint64
+}
+
+// log writes the event if it is sampled
+func (l *dropLogger) log(e dropEvent) {
+	if l.sample > 1 && atomic.AddUint64(&l.count, 1)%l.sample != 0 {
+		return
+	}
+	if l.json {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		log.Info(string(b))
+		return
+	}
+	log.Info(e.String())
+}
+
+// String returns the event as space separated key=value pairs
+func (e dropEvent) String() string {
+	var sb strings.Builder
+	sb.WriteString("client=")
+	sb.WriteString(e.Client)
+	sb.WriteString(" token=")
+	sb.WriteString(strconv.Quote(e.Token))
+	sb.WriteString(" qname=")
+	sb.WriteString(e.Qname)
+	sb.WriteString(" qtype=")
+	sb.WriteString(e.Qtype)
+	sb.WriteString(" rtype=")
+	sb.WriteString(e.Rtype)
+	if e.Rcode != "" {
+		sb.WriteString(" rcode=")
+		sb.WriteString(e.Rcode)
+	}
+	sb.WriteString(" balance=")
+	sb.WriteString(strconv.FormatFloat(e.Balance, 'f', 1, 64))
+	sb.WriteString(" action=")
+	sb.WriteString(e.Action)
+	return sb.String()
+}
+
+// logDrop writes an event to the drop log, if enabled. m is the response, or nil if the request was limited.
+func (rrl *RRL) logDrop(state request.Request, m *dns.Msg, t cache.Key, rtype string, balance float64, slip bool) {
+	if rrl.dropLog == nil {
+		return
+	}
+	e := dropEvent{
+		Client:  state.IP(),
+		Token:   tokenString(t),
+		Qname:   state.Name(),
+		Qtype:   state.Type(),
+		Rtype:   rtype,
+		Balance: balance,
+		Action:  actionDrop,
+	}
+	if m != nil {
+		e.Rcode = dns.RcodeToString[m.Rcode]
+	}
+	switch {
+	case rrl.reportOnly:
+		e.Action = actionReport
+	case slip:
+		e.Action = actionSlip
+	}
+	rrl.dropLog.log(e)
+}
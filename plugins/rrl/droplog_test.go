@@ -0,0 +1,95 @@
+package rrl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	golog "log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestDropEventString(t *testing.T) {
+	e := dropEvent{Client: "10.0.0.1", Token: "10.0.0.0/0/1/8f3c6b0a1d2e4f57", Qname: "example.com.", Qtype: "A",
+		Rtype: "response", Rcode: "NOERROR", Balance: -1.5, Action: actionSlip}
+	expected := `client=10.0.0.1 token="10.0.0.0/0/1/8f3c6b0a1d2e4f57" qname=example.com. qtype=A rtype=response rcode=NOERROR balance=-1.5 action=slip`
+	if e.String() != expected {
+		t.Errorf("expected %q, got %q", expected, e.String())
+	}
+
+	// requests have no rcode
+	e = dropEvent{Client: "10.0.0.1", Token: "10.0.0.0/7//", Qname: "example.com.", Qtype: "A", Rtype: "request", Balance: -0.5, Action: actionDrop}
+	expected = `client=10.0.0.1 token="10.0.0.0/7//" qname=example.com. qtype=A rtype=request balance=-0.5 action=drop`
+	if e.String() != expected {
+		t.Errorf("expected %q, got %q", expected, e.String())
+	}
+}
+
+func TestDropLoggerSample(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	l := &dropLogger{json: true, sample: 3}
+	for i := 0; i < 9; i++ {
+		l.log(dropEvent{Client: "10.0.0.1", Action: actionDrop})
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 sampled events, got %d: %q", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		i := strings.IndexByte(line, '{')
+		if i < 0 {
+			t.Fatalf("expected a json event, got %q", line)
+		}
+		var e dropEvent
+		if err := json.Unmarshal([]byte(line[i:]), &e); err != nil {
+			t.Fatalf("expected a json event, got %q: %v", line, err)
+		}
+		if e.Client != "10.0.0.1" || e.Action != actionDrop {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+}
+
+func TestServeDNSLogDrops(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	tc := test.Case{Qname: "example.com", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess}
+
+	rrl := defaultRRL()
+	rrl.Next = test.HandlerFunc(fixedAnswer)
+	rrl.Zones = []string{"example.com."}
+	rrl.window = 2 * second
+	rrl.responsesInterval = second
+	rrl.slipRatio = 2
+	rrl.dropLog = &dropLogger{sample: 1}
+	rrl.initTable()
+
+	ctx := context.TODO()
+	for i := 0; i < 4; i++ {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rrl.ServeDNS(ctx, w, tc.Msg())
+	}
+
+	out := buf.String()
+	if n := strings.Count(out, "rtype=response"); n != 3 {
+		t.Errorf("expected 3 logged events, got %d: %q", n, out)
+	}
+	if !strings.Contains(out, "action=drop") || !strings.Contains(out, "action=slip") {
+		t.Errorf("expected both a drop and a slip to be logged, got %q", out)
+	}
+	token := tokenString(rrl.buildToken(rTypeResponse, dns.TypeA, "example.com.", net.ParseIP("10.240.0.1")))
+	if !strings.Contains(out, `token="`+token+`"`) {
+		t.Errorf("expected the response token to be logged, got %q", out)
+	}
+}
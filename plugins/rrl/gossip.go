@@ -0,0 +1,381 @@
+package rrl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/rrl/plugins/rrl/cache"
+)
+
+// gossipStore is a store that shares debits with peers over UDP. The debits of each account are accumulated, and
+// sent to every peer once per interval. Debits received from peers are applied to the local accounts, and are not
+// sent on, so every instance must list every other instance as a peer.
+//
+// Every debit is sent, not only those of accounts in debt: a client spreading its queries across N instances may
+// stay within the allowance of each, and only the sum of its debits shows that it is over the allowance.
+type gossipStore struct {
+	Store
+	window    int64  // the longest window, bounding the debt that peers can apply
+	maxCredit int64  // the most credit of an account, that accounts added by peers start with
+	slipRatio uint32 // the slip ratio of accounts added by peers
+
+	listen   string
+	peers    []string
+	interval time.Duration
+	secret   []byte
+
+	// pending holds the debits of each account not yet sent to peers. It is replaced by an empty cache on each flush,
+	// so that sent debits are not removed one at a time under the write lock of each shard.
+	pending atomic.Pointer[cache.Cache[cache.Key, *int64]]
+	maxSize int
+
+	// seq is the sequence number of the last packet sent, the time it was sent, in nanoseconds
+	seq int64
+	// lastSeq holds the sequence number of the last packet received from each peer, to reject replayed packets. It
+	// is only used by the receive goroutine.
+	lastSeq map[netip.AddrPort]int64
+
+	conn *net.UDPConn
+	done chan struct{}
+}
+
+const (
+	gossipMagic     = "RRL2"
+	gossipHeaderLen = len(gossipMagic) + 8    // magic and sequence number
+	gossipRecordLen = 16 + 1 + 2 + 8 + 8      // prefix, type, qtype, name and debit
+	gossipMaxPacket = 1400                    // stay below common MTUs, to avoid fragmentation
+	gossipMaxAge    = int64(10 * time.Second) // the oldest packet accepted, which bounds the clock skew of peers
+)
+
+var errGossipInvalid = errors.New("invalid gossip message")
+
+// init creates the local store that the gossip store holds accounts in, and returns the gossip store
+func (g *gossipStore) init(o StoreOptions) (Store, error) {
+	local, err := newLocalStore(o)
+	if err != nil {
+		return nil, err
+	}
+	g.Store = local
+	g.window = o.Window
+	g.maxCredit = o.MaxCredit
+	g.slipRatio = o.SlipRatio
+	g.maxSize = o.MaxSize
+	g.pending.Store(cache.New[cache.Key, *int64](o.MaxSize))
+	g.lastSeq = make(map[netip.AddrPort]int64)
+	return g, nil
+}
+
+// Debited accumulates the debit of the account of key, to be sent to peers
+func (g *gossipStore) Debited(key cache.Key, allowance int64) {
+	pending := g.pending.Load()
+	if d, found := pending.Use(key); found {
+		atomic.AddInt64(d, allowance)
+		return
+	}
+	pending.UpdateAdd(key,
+		func(d *int64) *int64 {
+			atomic.AddInt64(d, allowance)
+			return d
+		},
+		func() *int64 {
+			d := allowance
+			return &d
+		})
+}
+
+// Start listens for debits from peers, and sends debits to peers in the background
+func (g *gossipStore) Start() error {
+	laddr, err := net.ResolveUDPAddr("udp", g.listen)
+	if err != nil {
+		return err
+	}
+	peerAddrs := make([]*net.UDPAddr, 0, len(g.peers))
+	for _, p := range g.peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return err
+		}
+		peerAddrs = append(peerAddrs, addr)
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	g.conn = conn
+	g.done = make(chan struct{})
+	go g.receive(conn, peerAddrs)
+	go g.run(conn, peerAddrs, g.done)
+	return nil
+}
+
+// Stop stops listening and sending
+func (g *gossipStore) Stop() error {
+	if g.conn == nil {
+		return nil
+	}
+	close(g.done)
+	err := g.conn.Close()
+	g.conn = nil
+	return err
+}
+
+// run sends the pending debits to peers every interval, until done is closed
+func (g *gossipStore) run(conn *net.UDPConn, peers []*net.UDPAddr, done chan struct{}) {
+	tick := time.NewTicker(g.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+			for _, pkt := range g.flush() {
+				for _, p := range peers {
+					if _, err := conn.WriteToUDP(pkt, p); err != nil {
+						log.Debugf("failed to send gossip to %v: %v", p, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// flush returns the pending debits encoded in packets, and clears them
+func (g *gossipStore) flush() [][]byte {
+	// a debit made to the old cache after it is ranged over is lost, which is rare enough not to matter
+	pending := g.pending.Swap(cache.New[cache.Key, *int64](g.maxSize))
+	var pkts [][]byte
+	pkt := make([]byte, gossipHeaderLen, gossipMaxPacket)
+	pending.Range(func(key cache.Key, d *int64) bool {
+		debit := atomic.LoadInt64(d)
+		if debit <= 0 {
+			return true
+		}
+		if len(pkt)+gossipRecordLen+sha256.Size > gossipMaxPacket {
+			pkts = append(pkts, g.seal(pkt))
+			pkt = make([]byte, gossipHeaderLen, gossipMaxPacket)
+		}
+		pkt = appendGossipRecord(pkt, key, debit)
+		return true
+	})
+	if len(pkt) > gossipHeaderLen {
+		pkts = append(pkts, g.seal(pkt))
+	}
+	return pkts
+}
+
+// seal writes the header of pkt, with the next sequence number, and appends its message authentication code
+func (g *gossipStore) seal(pkt []byte) []byte {
+	g.seq = max(time.Now().UnixNano(), g.seq+1)
+	copy(pkt, gossipMagic)
+	binary.BigEndian.PutUint64(pkt[len(gossipMagic):gossipHeaderLen], uint64(g.seq))
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(pkt)
+	return mac.Sum(pkt)
+}
+
+// fresh returns true if seq, received from a peer at now, is neither too old nor a replay of a packet already
+// received from the peer, and records it as the last sequence number of the peer.
+func (g *gossipStore) fresh(from netip.AddrPort, seq, now int64) bool {
+	if seq < now-gossipMaxAge || seq > now+gossipMaxAge {
+		return false
+	}
+	from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+	last, found := g.lastSeq[from]
+	if found && seq <= last {
+		return false
+	}
+	// peers may send from any port, bound the map in case they send from many. Packets older than gossipMaxAge are
+	// still rejected once it is cleared.
+	if !found && len(g.lastSeq) >= 4*len(g.peers) {
+		clear(g.lastSeq)
+	}
+	g.lastSeq[from] = seq
+	return true
+}
+
+// receive applies the debits received from peers, until conn is closed
+func (g *gossipStore) receive(conn *net.UDPConn, peers []*net.UDPAddr) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warningf("failed to receive gossip: %v", err)
+			continue
+		}
+		if !isPeer(peers, addr.IP) {
+			log.Debugf("ignored gossip from %v, not a peer", addr)
+			continue
+		}
+		seq, records, err := openGossip(buf[:n], g.secret)
+		if err != nil {
+			log.Debugf("ignored gossip from %v: %v", addr, err)
+			continue
+		}
+		if !g.fresh(addr.AddrPort(), seq, time.Now().UnixNano()) {
+			log.Debugf("ignored gossip from %v, replayed or too old", addr)
+			continue
+		}
+		decodeGossipRecords(records, g.apply)
+	}
+}
+
+// apply debits the account of key with the debit of a peer, adding the account if it does not exist
+func (g *gossipStore) apply(key cache.Key, debit int64) {
+	_, err := g.UpdateAdd(key,
+		func(ra *ResponseAccount) *ResponseAccount {
+			draw(&ra.allowTime, debit, g.maxCredit, g.window, time.Now().UnixNano())
+			return ra
+		},
+		func() *ResponseAccount {
+			balance := g.maxCredit - debit
+			if balance < -g.window {
+				balance = -g.window
+			}
+			return &ResponseAccount{
+				allowTime:     time.Now().UnixNano() - balance,
+				slipCountdown: g.slipRatio,
+			}
+		})
+	if err != nil {
+		log.Debugf("failed to apply gossip: %v", err)
+	}
+}
+
+// parseGossipStore parses the block of a gossip store, with each option on a line of its own, e.g.
+//
+//	store gossip {
+//	    listen :9155
+//	    peers 10.0.0.2:9155
+//	    secret s3cr3t
+//	}
+func parseGossipStore(c *caddy.Controller) (func(StoreOptions) (Store, error), error) {
+	g := &gossipStore{interval: time.Second}
+	if !c.Next() || c.Val() != "{" {
+		return nil, c.Err("store gossip requires a block")
+	}
+	for c.Next() {
+		switch c.Val() {
+		case "}":
+			if g.listen == "" {
+				return nil, c.Err("store gossip requires listen")
+			}
+			if len(g.peers) == 0 {
+				return nil, c.Err("store gossip requires peers")
+			}
+			if g.secret == nil {
+				return nil, c.Err("store gossip requires secret")
+			}
+			return g.init, nil
+		case "listen":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if _, _, err := net.SplitHostPort(args[0]); err != nil {
+				return nil, c.Errf("%v invalid address. %v", c.Val(), err)
+			}
+			g.listen = args[0]
+		case "peers":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, a := range args {
+				if _, _, err := net.SplitHostPort(a); err != nil {
+					return nil, c.Errf("%v invalid address. %v", c.Val(), err)
+				}
+			}
+			g.peers = append(g.peers, args...)
+		case "interval":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			d, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Errf("%v invalid value. %v", c.Val(), err)
+			}
+			if d <= 0 {
+				return nil, c.Errf("%v must be positive", c.Val())
+			}
+			g.interval = d
+		case "secret":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if args[0] == "" {
+				return nil, c.Errf("%v cannot be empty", c.Val())
+			}
+			g.secret = []byte(args[0])
+		default:
+			return nil, c.Errf("unknown gossip property '%s'", c.Val())
+		}
+	}
+	return nil, c.EOFErr()
+}
+
+// isPeer returns true if ip is the address of one of peers
+func isPeer(peers []*net.UDPAddr, ip net.IP) bool {
+	for _, p := range peers {
+		if p.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendGossipRecord appends the debit of the account of key to b
+func appendGossipRecord(b []byte, key cache.Key, debit int64) []byte {
+	b = append(b, key.Prefix[:]...)
+	b = append(b, key.Type)
+	b = binary.BigEndian.AppendUint16(b, key.Qtype)
+	b = binary.BigEndian.AppendUint64(b, key.Name)
+	return binary.BigEndian.AppendUint64(b, uint64(debit))
+}
+
+// openGossip authenticates the message b with secret, and returns its sequence number and its records
+func openGossip(b, secret []byte) (int64, []byte, error) {
+	if len(b) < gossipHeaderLen+sha256.Size {
+		return 0, nil, errGossipInvalid
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(b[:len(b)-sha256.Size])
+	if !hmac.Equal(mac.Sum(nil), b[len(b)-sha256.Size:]) {
+		return 0, nil, errors.New("gossip message authentication failed")
+	}
+	if string(b[:len(gossipMagic)]) != gossipMagic {
+		return 0, nil, errGossipInvalid
+	}
+	records := b[gossipHeaderLen : len(b)-sha256.Size]
+	if len(records)%gossipRecordLen != 0 {
+		return 0, nil, errGossipInvalid
+	}
+	return int64(binary.BigEndian.Uint64(b[len(gossipMagic):gossipHeaderLen])), records, nil
+}
+
+// decodeGossipRecords calls f with each debit in the records b, returned by openGossip
+func decodeGossipRecords(b []byte, f func(key cache.Key, debit int64)) {
+	for ; len(b) >= gossipRecordLen; b = b[gossipRecordLen:] {
+		var key cache.Key
+		copy(key.Prefix[:], b[:16])
+		key.Type = b[16]
+		key.Qtype = binary.BigEndian.Uint16(b[17:19])
+		key.Name = binary.BigEndian.Uint64(b[19:27])
+		debit := int64(binary.BigEndian.Uint64(b[27:35]))
+		if debit <= 0 {
+			continue
+		}
+		f(key, debit)
+	}
+}
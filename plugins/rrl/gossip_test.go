@@ -0,0 +1,238 @@
+package rrl
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/rrl/plugins/rrl/cache"
+)
+
+func TestGossipEncodeDecode(t *testing.T) {
+	keys := map[cache.Key]int64{
+		testToken("a"): second / 10,
+		testToken("b"): 3 * second,
+		{Prefix: [16]byte{15: 1}, Type: rTypeResponse, Qtype: 28, Name: 12345}: 1,
+	}
+
+	tests := []struct {
+		decodeWith []byte
+		tamper     int // the offset of a byte to change, if not 0
+		shouldErr  bool
+	}{
+		{decodeWith: []byte("s3cr3t")},
+		{decodeWith: []byte("wrong"), shouldErr: true},
+		{decodeWith: nil, shouldErr: true},
+		{decodeWith: []byte("s3cr3t"), tamper: gossipHeaderLen + gossipRecordLen - 2, shouldErr: true},
+		{decodeWith: []byte("s3cr3t"), tamper: gossipHeaderLen - 1, shouldErr: true},
+	}
+
+	for i, test := range tests {
+		g := &gossipStore{secret: []byte("s3cr3t"), maxSize: 100}
+		g.pending.Store(cache.New[cache.Key, *int64](100))
+		for k, d := range keys {
+			g.Debited(k, d)
+		}
+		pkts := g.flush()
+		if len(pkts) != 1 {
+			t.Fatalf("Test %d: expected 1 packet, got %d", i, len(pkts))
+		}
+		pkt := pkts[0]
+		if test.tamper != 0 {
+			pkt[test.tamper]++
+		}
+
+		got := map[cache.Key]int64{}
+		seq, records, err := openGossip(pkt, test.decodeWith)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got %v", i, err)
+			continue
+		}
+		if seq != g.seq {
+			t.Errorf("Test %d: expected sequence number %v, got %v", i, g.seq, seq)
+		}
+		decodeGossipRecords(records, func(k cache.Key, d int64) { got[k] = d })
+		if len(got) != len(keys) {
+			t.Errorf("Test %d: expected %d debits, got %d", i, len(keys), len(got))
+		}
+		for k, d := range keys {
+			if got[k] != d {
+				t.Errorf("Test %d: expected debit %v for %v, got %v", i, d, tokenString(k), got[k])
+			}
+		}
+	}
+
+	g := &gossipStore{secret: []byte("s3cr3t")}
+	for i, b := range [][]byte{nil, []byte("RRL"), []byte("XXXX"), g.seal(make([]byte, gossipHeaderLen+3))} {
+		if _, _, err := openGossip(b, g.secret); err == nil {
+			t.Errorf("Test %d: expected error decoding %v, got nil", i, b)
+		}
+	}
+}
+
+func TestGossipFlush(t *testing.T) {
+	g := &gossipStore{secret: []byte("s3cr3t"), maxSize: 10000}
+	g.pending.Store(cache.New[cache.Key, *int64](10000))
+	for i := 0; i < 100; i++ {
+		g.Debited(cache.Key{Name: uint64(i)}, second)
+		g.Debited(cache.Key{Name: uint64(i)}, second)
+	}
+
+	// records are split across packets that fit the maximum size, each with a greater sequence number
+	n := 0
+	var last int64
+	for _, pkt := range g.flush() {
+		if len(pkt) > gossipMaxPacket {
+			t.Errorf("expected packets of at most %d bytes, got %d", gossipMaxPacket, len(pkt))
+		}
+		seq, records, err := openGossip(pkt, g.secret)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+			continue
+		}
+		if seq <= last {
+			t.Errorf("expected sequence number above %v, got %v", last, seq)
+		}
+		last = seq
+		decodeGossipRecords(records, func(_ cache.Key, d int64) {
+			if d != 2*second {
+				t.Errorf("expected accumulated debit %v, got %v", 2*second, d)
+			}
+			n++
+		})
+	}
+	if n != 100 {
+		t.Errorf("expected 100 debits, got %d", n)
+	}
+
+	// flushed debits are cleared
+	if pkts := g.flush(); len(pkts) != 0 {
+		t.Errorf("expected no packets after flush, got %d", len(pkts))
+	}
+	if l := g.pending.Load().Len(); l != 0 {
+		t.Errorf("expected no pending debits after flush, got %d", l)
+	}
+}
+
+func TestGossipFresh(t *testing.T) {
+	g := &gossipStore{peers: []string{"192.0.2.1:9155"}, lastSeq: map[netip.AddrPort]int64{}}
+	peer := netip.MustParseAddrPort("192.0.2.1:9155")
+	now := int64(1000 * second)
+
+	tests := []struct {
+		from     netip.AddrPort
+		seq      int64
+		expected bool
+	}{
+		{from: peer, seq: now, expected: true},
+		{from: peer, seq: now, expected: false}, // replayed
+		{from: peer, seq: now - 1, expected: false},
+		{from: peer, seq: now + 1, expected: true},
+		{from: netip.MustParseAddrPort("[::ffff:192.0.2.1]:9155"), seq: now + 1, expected: false}, // replayed, mapped
+		{from: netip.MustParseAddrPort("192.0.2.1:9156"), seq: now, expected: true},
+		{from: peer, seq: now - gossipMaxAge - 1, expected: false}, // too old
+		{from: peer, seq: now + gossipMaxAge + 1, expected: false}, // too far ahead
+		{from: peer, seq: now + gossipMaxAge, expected: true},
+	}
+	for i, test := range tests {
+		if fresh := g.fresh(test.from, test.seq, now); fresh != test.expected {
+			t.Errorf("Test %d: expected fresh %v for %v from %v, got %v", i, test.expected, test.seq, test.from, fresh)
+		}
+	}
+
+	// the map is bounded when a peer sends from many ports
+	for port := uint16(1); port < 100; port++ {
+		g.fresh(netip.AddrPortFrom(peer.Addr(), port), now, now)
+	}
+	if l := len(g.lastSeq); l > 4*len(g.peers) {
+		t.Errorf("expected at most %d sequence numbers, got %d", 4*len(g.peers), l)
+	}
+}
+
+func TestGossipShare(t *testing.T) {
+	// b only accepts debits from the loopback address a sends from
+	b := defaultRRL()
+	b.window = 10 * second
+	b.responsesInterval = second / 10
+	bg := startGossip(t, &b, &gossipStore{listen: "127.0.0.1:0", peers: []string{"127.0.0.1:9"}, interval: time.Hour, secret: []byte("s3cr3t")})
+	defer bg.Stop()
+
+	a := defaultRRL()
+	a.window = 10 * second
+	a.responsesInterval = second / 10
+	ag := startGossip(t, &a, &gossipStore{listen: "127.0.0.1:0", peers: []string{bg.conn.LocalAddr().String()}, interval: 10 * time.Millisecond, secret: []byte("s3cr3t")})
+	defer ag.Stop()
+
+	// 30 responses to a client of a use up 3 seconds of allowance, which b applies to the same account
+	token := a.buildToken(rTypeResponse, 1, "example.org.", net.ParseIP("192.0.2.1"))
+	for i := 0; i < 30; i++ {
+		a.debit(&a.policy, a.responsesInterval, token)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		// wait until b has applied all of the debits, possibly across several flushes
+		if ra, found := b.table.Get(token); found && time.Now().UnixNano()-atomic.LoadInt64(&ra.allowTime) < -second-second/2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	balance, _, err := b.debit(&b.policy, b.responsesInterval, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one second of credit, less 31 responses, plus the credit earned since
+	if expected := second - 31*b.responsesInterval; balance < expected || balance > expected+second/10 {
+		t.Errorf("expected balance of about %v, got %v", expected, balance)
+	}
+
+	// other clients are not affected
+	other := a.buildToken(rTypeResponse, 1, "example.org.", net.ParseIP("198.51.100.1"))
+	if _, found := b.table.Get(other); found {
+		t.Error("expected no account for a client without debits")
+	}
+}
+
+func TestGossipIgnoresNonPeers(t *testing.T) {
+	rrl := defaultRRL()
+	g := startGossip(t, &rrl, &gossipStore{listen: "127.0.0.1:0", peers: []string{"192.0.2.1:9155"}, interval: time.Hour, secret: []byte("s3cr3t")})
+	defer g.Stop()
+
+	conn, err := net.Dial("udp", g.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sender := &gossipStore{secret: g.secret}
+	if _, err := conn.Write(sender.seal(appendGossipRecord(make([]byte, gossipHeaderLen), testToken("a"), second))); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if l := rrl.table.Len(); l != 0 {
+		t.Errorf("expected debits from a non-peer to be ignored, got %d accounts", l)
+	}
+}
+
+// startGossip sets the table of rrl to the gossip store g, and starts it
+func startGossip(t *testing.T, rrl *RRL, g *gossipStore) *gossipStore {
+	t.Helper()
+	rrl.newStore = g.init
+	if err := rrl.initTable(); err != nil {
+		t.Fatal(err)
+	}
+	if rrl.table != Store(g) || rrl.debits != DebitObserver(g) {
+		t.Fatal("expected the gossip store to be the table")
+	}
+	if err := g.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
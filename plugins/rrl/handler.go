@@ -3,12 +3,16 @@ package rrl
 import (
 	"context"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/plugin/pkg/nonwriter"
 	"github.com/coredns/coredns/request"
+	"github.com/coredns/rrl/plugins/rrl/cache"
 )
 
 // Name implements the Handler interface.
@@ -17,26 +21,58 @@ func (rrl *RRL) Name() string { return "rrl" }
 // ServeDNS implements the Handler interface.
 func (rrl *RRL) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
+	ip := clientIP(w)
+
+	server := metrics.WithServer(ctx)
+	now := time.Now().Unix()
+	rrl.reportTable(server, now)
+
+	// measure the total query rate, and export the resulting scale factor once per second
+	if rrl.qpsScale != 0 && rrl.qps.tick(now) {
+		QPSScale.WithLabelValues(server).Set(rrl.scale())
+	}
+
+	if rrl.exemptClients != nil || rrl.exemptFile != nil || rrl.blockFile != nil {
+		// dont limit requests or responses for exempt clients
+		if rrl.exempt(ip) {
+			return plugin.NextOrFailure(rrl.Name(), rrl.Next, ctx, w, r)
+		}
+		// drop requests from blocked clients, regardless of zone
+		if rrl.blocked(ip) {
+			log.Debugf("request from blocked client %v", state.IP())
+			RequestsBlocked.WithLabelValues(server).Add(1)
+			if !rrl.reportOnly {
+				return dns.RcodeSuccess, errBlocked
+			}
+		}
+	}
 
 	// only limit rates for applied zones
-	zone := plugin.Zones(rrl.Zones).Matches(state.Name())
+	zone := matchZone(rrl.Zones, state.Name())
 	if zone == "" {
 		return plugin.NextOrFailure(rrl.Name(), rrl.Next, ctx, w, r)
 	}
 
 	// Limit request rate
 	if rrl.requestsInterval != 0 {
-		t := rrl.addrPrefix(state.RemoteAddr())
-		b, _, err := rrl.debit(rrl.requestsInterval, t) // ignore slip when request limit is exceeded (there is no response to slip)
+		t := rrl.buildToken(rTypeRequest, 0, "", ip)
+		b, _, err := rrl.debit(&rrl.policy, rrl.requestsInterval, t) // ignore slip when request limit is exceeded (there is no response to slip)
 		// if the balance is negative, drop the request (don't write response to client)
 		if b < 0 && err == nil {
-			log.Debugf("request rate exceeded from %v (token='%v', balance=%.1f)", state.IP(), t, float64(b)/float64(rrl.requestsInterval))
-			RequestsExceeded.WithLabelValues(state.IP()).Add(1)
+			log.Debugf("request rate exceeded from %v (token='%v', balance=%.1f)", state.IP(), tokenString(t), float64(b)/float64(rrl.requestsInterval))
+			rrl.countExceeded(RequestsExceeded, state)
+			rrl.logDrop(state, nil, t, rtypeStrings[rTypeRequest], float64(b)/float64(rrl.requestsInterval), false)
 			// always return success, to prevent writing of error statuses to client
 			if !rrl.reportOnly {
 				return dns.RcodeSuccess, errReqRateLimit
 			}
 		}
+		if err != nil {
+			// there is no response to slip, so only drop when the table is full. A slipping policy slips the response instead.
+			if limited, slip := rrl.tableError(server, err, rrl.onTableFull); limited && !slip && !rrl.reportOnly {
+				return dns.RcodeSuccess, errReqRateLimit
+			}
+		}
 	}
 
 	// Limit response rate
@@ -45,52 +81,132 @@ func (rrl *RRL) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 		return plugin.NextOrFailure(rrl.Name(), rrl.Next, ctx, w, r)
 	}
 
-	// create a non-writer, because we need to look at the response before writing to the client
-	nw := nonwriter.New(w)
+	// get a non-writer, because we need to look at the response before writing to the client
+	nw := nonwriters.Get().(*nonwriter.Writer)
+	nw.ResponseWriter = w
+	defer func() {
+		nw.ResponseWriter, nw.Msg = nil, nil
+		nonwriters.Put(nw)
+	}()
 	rcode, err := plugin.NextOrFailure(rrl.Name(), rrl.Next, ctx, nw, r)
 	if !plugin.ClientWrite(rcode) {
 		return rcode, err
 	}
 
 	// get token for response and debit the balance
+	p := rrl.policyForZone(state.Name())
 	rtype := responseType(nw.Msg)
-	t := rrl.responseToToken(ctx, nw, rtype)
-	allowance := rrl.allowanceForRtype(rtype)
+	rtypeName := rtypeStrings[rtype]
+	t := rrl.responseToToken(ctx, nw, rtype, ip)
+	allowance := rrl.scaleInterval(p.allowanceForResponse(rtype, nw.Msg.Question[0].Qtype, nw.Msg.Len()))
+
+	// limit the rate of all responses to the client prefix, regardless of response type
+	if rrl.allInterval != 0 {
+		at := rrl.buildToken(rTypeAll, 0, "", ip)
+		allAllowance := rrl.scaleInterval(rrl.allInterval)
+		b, _, err := rrl.debit(&rrl.policy, allAllowance, at) // ignore slip, responses never slip once all-per-second is exceeded
+		if b < 0 && err == nil {
+			log.Debugf("all response rate exceeded to %v for \"%v\" %v (token='%v', balance=%.1f)", nw.RemoteAddr().String(), nw.Msg.Question[0].String(), dns.RcodeToString[nw.Msg.Rcode], tokenString(at), float64(b)/float64(allAllowance))
+			rrl.countExceeded(ResponsesExceeded, state)
+			rrl.logDrop(state, nw.Msg, at, rtypeStrings[rTypeAll], float64(b)/float64(allAllowance), false)
+			if !rrl.reportOnly {
+				return rrl.limit(w, nw.Msg, rcode, false, server, zone, rtypeName)
+			}
+		}
+		if err != nil {
+			if limited, slip := rrl.tableError(server, err, rrl.onTableFull); limited && !rrl.reportOnly {
+				return rrl.limit(w, nw.Msg, rcode, slip, server, zone, rtypeName)
+			}
+		}
+	}
+
+	// limit responses to client prefixes that have sustained a high amplification factor
+	if rrl.maxAmplification != 0 {
+		at := rrl.buildToken(rTypeAmplification, 0, "", ip)
+		limited, slip, err := rrl.amplified(at, r.Len(), nw.Msg.Len())
+		if limited && err == nil {
+			log.Debugf("amplification factor exceeded to %v for \"%v\" %v (token='%v')", nw.RemoteAddr().String(), nw.Msg.Question[0].String(), dns.RcodeToString[nw.Msg.Rcode], tokenString(at))
+			rrl.countExceeded(ResponsesExceeded, state)
+			rrl.logDrop(state, nw.Msg, at, rtypeStrings[rTypeAmplification], 0, slip)
+			if !rrl.reportOnly {
+				return rrl.limit(w, nw.Msg, rcode, slip, server, zone, rtypeName)
+			}
+		}
+		if err != nil {
+			if limited, slip := rrl.tableError(server, err, rrl.onTableFull); limited && !rrl.reportOnly {
+				return rrl.limit(w, nw.Msg, rcode, slip, server, zone, rtypeName)
+			}
+		}
+	}
+
 	// a zero allowance indicates that no RRL should be performed for the response type, so write the response to client
 	if allowance == 0 {
+		ResponsesAllowed.WithLabelValues(server, zone, rtypeName).Add(1)
 		err = w.WriteMsg(nw.Msg)
 		return rcode, err
 	}
-	b, slip, err := rrl.debit(allowance, t)
+	b, slip, err := rrl.debit(p, allowance, t)
 
 	// if the balance is negative, drop the response (don't write response to client)
 	if b < 0 && err == nil {
-		log.Debugf("response rate exceeded to %v for \"%v\" %v (token='%v', balance=%.1f)", nw.RemoteAddr().String(), nw.Msg.Question[0].String(), dns.RcodeToString[nw.Msg.Rcode], t, float64(b)/float64(allowance))
-		// always return success, to prevent writing of error statuses to client
-		ResponsesExceeded.WithLabelValues(state.IP()).Add(1)
+		log.Debugf("response rate exceeded to %v for \"%v\" %v (token='%v', balance=%.1f)", nw.RemoteAddr().String(), nw.Msg.Question[0].String(), dns.RcodeToString[nw.Msg.Rcode], tokenString(t), float64(b)/float64(allowance))
+		rrl.countExceeded(ResponsesExceeded, state)
+		rrl.logDrop(state, nw.Msg, t, rtypeName, float64(b)/float64(allowance), slip)
 		if !rrl.reportOnly {
-			if !slip {
-				// drop the response.  Return success, otherwise server will return an error response to client.
-				return dns.RcodeSuccess, errRespRateLimit
-			}
-			// truncate the response to just the header and let it slip through
-			nw.Msg.Ns = []dns.RR{}
-			nw.Msg.Answer = []dns.RR{}
-			nw.Msg.Extra = []dns.RR{}
-			nw.Msg.Truncated = true
+			return rrl.limit(w, nw.Msg, rcode, slip, server, zone, rtypeName)
 		}
 	}
 
 	if err != nil {
-		log.Warningf("%v", err)
+		if limited, slip := rrl.tableError(server, err, p.onTableFull); limited && !rrl.reportOnly {
+			return rrl.limit(w, nw.Msg, rcode, slip, server, zone, rtypeName)
+		}
 	}
 
 	// write response to client
+	ResponsesAllowed.WithLabelValues(server, zone, rtypeName).Add(1)
 	err = w.WriteMsg(nw.Msg)
 	return rcode, err
 }
 
+// limit drops the response, or writes it truncated if slip is true, counting the outcome under labels
+func (rrl *RRL) limit(w dns.ResponseWriter, m *dns.Msg, rcode int, slip bool, labels ...string) (int, error) {
+	if !slip {
+		ResponsesDropped.WithLabelValues(labels...).Add(1)
+		// always return success, to prevent writing of error statuses to client
+		return dns.RcodeSuccess, errRespRateLimit
+	}
+	truncate(m)
+	ResponsesSlipped.WithLabelValues(labels...).Add(1)
+	err := w.WriteMsg(m)
+	return rcode, err
+}
+
+// tableError logs an error from the table. It returns whether the response should be limited, and if so whether
+// it should slip, according to action when the error is a failure to add an account to a full table.
+func (rrl *RRL) tableError(server string, err error, action uint8) (limited, slip bool) {
+	if !errors.Is(err, cache.ErrShardFull) {
+		log.Warningf("%v", err)
+		return false, false
+	}
+	TableInsertFailures.WithLabelValues(server).Add(1)
+	rrl.tableFullLog.log()
+	return action != tableFullAllow, action == tableFullSlip
+}
+
+// truncate truncates the response to just the header so it can slip through
+func truncate(m *dns.Msg) {
+	m.Ns = []dns.RR{}
+	m.Answer = []dns.RR{}
+	m.Extra = []dns.RR{}
+	m.Truncated = true
+}
+
+// nonwriters pools the non-writers used to hold responses, to avoid allocating one per response
+var nonwriters = sync.Pool{New: func() interface{} { return new(nonwriter.Writer) }}
+
 var (
 	errReqRateLimit  = errors.New("query rate exceeded the limit")
 	errRespRateLimit = errors.New("response rate exceeded the limit")
+	errBlocked       = errors.New("client is blocked")
 )
@@ -2,9 +2,13 @@ package rrl
 
 import (
 	"context"
+	"net"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/rrl/plugins/rrl/cidr"
 
 	"github.com/miekg/dns"
 
@@ -107,6 +111,154 @@ func TestServeDNSForeignZone(t *testing.T) {
 	}
 
 }
+func TestServeDNSExemptClients(t *testing.T) {
+	tc := test.Case{Qname: "example.com", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess}
+
+	rrl := defaultRRL()
+	rrl.Next = test.HandlerFunc(fixedAnswer)
+	rrl.Zones = []string{"example.com."}
+	rrl.window = 2 * second
+	rrl.responsesInterval = second
+	rrl.requestsInterval = second
+	rrl.exemptClients = cidr.New()
+	n, _ := cidr.Parse("10.240.0.0/16")
+	rrl.exemptClients.Insert(n)
+	rrl.initTable()
+
+	ctx := context.TODO()
+
+	var w *dnstest.Recorder
+
+	// deplete balance to what would be negative if the client was not exempt
+	for i := 0; i < 3; i++ {
+		w = dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := rrl.ServeDNS(ctx, w, tc.Msg())
+		if err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+	}
+
+	// ensure that the last message was written to the client
+	if w.Len == 0 {
+		t.Errorf("expected message to be written to client")
+	}
+
+	// a client outside of the exempt network is still rate limited
+	for i := 0; i < 3; i++ {
+		w = dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "10.241.0.1"})
+		rrl.ServeDNS(ctx, w, tc.Msg())
+	}
+	if w.Len != 0 {
+		t.Errorf("expected message to be dropped")
+	}
+}
+
+func TestServeDNSZonePolicy(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.Next = test.HandlerFunc(fixedAnswer)
+	rrl.Zones = []string{"com."}
+	rrl.window = 2 * second
+	rrl.responsesInterval = second
+	rrl.zonePolicies = map[string]*policy{
+		"example.com.": {window: 2 * second}, // a zero allowance disables rate limiting in example.com.
+	}
+	rrl.policyZones = []string{"example.com."}
+	rrl.initTable()
+
+	ctx := context.TODO()
+
+	var w *dnstest.Recorder
+
+	// deplete the balance of a name in each zone to what would be negative if we were rate limiting
+	for i := 0; i < 3; i++ {
+		w = dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := rrl.ServeDNS(ctx, w, test.Case{Qname: "www.example.com.", Qtype: dns.TypeA}.Msg())
+		if err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+	}
+	if w.Len == 0 {
+		t.Errorf("expected message to be written to client")
+	}
+
+	for i := 0; i < 3; i++ {
+		w = dnstest.NewRecorder(&test.ResponseWriter{})
+		rrl.ServeDNS(ctx, w, test.Case{Qname: "www.example2.com.", Qtype: dns.TypeA}.Msg())
+	}
+	if w.Len != 0 {
+		t.Errorf("expected message to be dropped")
+	}
+}
+
+func TestServeDNSBytesPerSecond(t *testing.T) {
+	tc := test.Case{Qname: "example.com", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess}
+
+	rrl := defaultRRL()
+	rrl.Next = test.HandlerFunc(fixedAnswer)
+	rrl.Zones = []string{"example.com."}
+	rrl.window = 2 * second
+	rrl.responsesInterval = second / 1000
+	// the size of each response exceeds the budget, so after the first response, the next is dropped
+	// despite the generous per-second allowance
+	rrl.bytesPerSecond = map[uint8]int64{rTypeResponse: 20}
+	rrl.initTable()
+
+	ctx := context.TODO()
+
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err := rrl.ServeDNS(ctx, w, tc.Msg())
+	if err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if w.Len == 0 {
+		t.Errorf("expected message to be written to client")
+	}
+
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = rrl.ServeDNS(ctx, w, tc.Msg())
+	if err == nil {
+		t.Error("expected rate limit error, got no error")
+	}
+	if w.Len != 0 {
+		t.Errorf("expected message to be dropped")
+	}
+}
+
+func TestServeDNSBlocked(t *testing.T) {
+	tc := test.Case{Qname: "example.com", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess}
+
+	rrl := defaultRRL()
+	rrl.Next = test.HandlerFunc(fixedAnswer)
+	rrl.Zones = []string{"example.com."}
+	rrl.blockFile = &cidrFile{}
+	tr, _ := parseCIDRs(strings.NewReader("10.240.0.0/16"))
+	rrl.blockFile.trie.Store(tr)
+	rrl.initTable()
+
+	ctx := context.TODO()
+
+	// blocked clients are dropped, even for zones rrl does not apply to
+	for _, qname := range []string{"example.com.", "example.org."} {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := rrl.ServeDNS(ctx, w, test.Case{Qname: qname, Qtype: dns.TypeA}.Msg())
+		if err != errBlocked {
+			t.Errorf("expected error %v, got: %v", errBlocked, err)
+		}
+		if w.Len != 0 {
+			t.Errorf("expected message to be dropped")
+		}
+	}
+
+	w := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "10.241.0.1"})
+	_, err := rrl.ServeDNS(ctx, w, tc.Msg())
+	if err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if w.Len == 0 {
+		t.Errorf("expected message to be written to client")
+	}
+}
+
 func TestServeDNSZeroAllowance(t *testing.T) {
 	tc := test.Case{Qname: "example.com", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess}
 
@@ -155,7 +307,7 @@ func TestServeDNSRateLimitSlips(t *testing.T) {
 	})
 }
 
-func testServeDNSRateLimitSlip(t *testing.T, slipRatio uint, expectedSlips int) {
+func testServeDNSRateLimitSlip(t *testing.T, slipRatio uint32, expectedSlips int) {
 	tc := test.Case{Qname: "example.com", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess}
 
 	rrl := defaultRRL()
@@ -202,6 +354,114 @@ func testServeDNSRateLimitSlip(t *testing.T, slipRatio uint, expectedSlips int)
 	}
 }
 
+func TestServeDNSAllPerSecond(t *testing.T) {
+	tc := test.Case{Qname: "example.com", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess}
+
+	rrl := defaultRRL()
+	rrl.Next = test.HandlerFunc(fixedAnswer)
+	rrl.Zones = []string{"example.com."}
+	rrl.window = 2 * second
+	rrl.responsesInterval = second / 2
+	rrl.allInterval = second
+	rrl.slipRatio = 1
+	rrl.initTable()
+
+	ctx := context.TODO()
+
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err := rrl.ServeDNS(ctx, w, tc.Msg())
+	if err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if w.Len == 0 {
+		t.Errorf("expected message to be written to client")
+	}
+
+	// once all-per-second is exceeded, nothing should slip through despite the slip ratio of 1
+	for i := 0; i < 10; i++ {
+		w = dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := rrl.ServeDNS(ctx, w, tc.Msg())
+		if err == nil {
+			t.Error("expected rate limit error, got no error")
+		}
+		if w.Msg != nil {
+			t.Errorf("expected message to be dropped, got %v", w.Msg)
+		}
+	}
+}
+
+func TestServeDNSTableFull(t *testing.T) {
+	tests := []struct {
+		action    uint8
+		written   bool
+		truncated bool
+	}{
+		{action: tableFullAllow, written: true},
+		{action: tableFullDrop, written: false},
+		{action: tableFullSlip, written: true, truncated: true},
+	}
+
+	for i, tt := range tests {
+		tc := test.Case{Qname: "example.com", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess}
+
+		rrl := defaultRRL()
+		rrl.Next = test.HandlerFunc(fixedAnswer)
+		rrl.Zones = []string{"example.com."}
+		rrl.responsesInterval = second
+		rrl.onTableFull = tt.action
+		rrl.maxTableSize = 0
+		rrl.initTable()
+		// fill every shard of the table with accounts that cannot be evicted
+		rrl.table.SetEvict(func(*ResponseAccount) bool { return false })
+		for j := 0; j < 10000; j++ {
+			rrl.table.Add(testToken(strconv.Itoa(j)), &ResponseAccount{})
+		}
+
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := rrl.ServeDNS(context.TODO(), w, tc.Msg())
+		if tt.written != (w.Msg != nil) {
+			t.Errorf("Test %d: expected written %v, got %v (err %v)", i, tt.written, w.Msg != nil, err)
+			continue
+		}
+		if !tt.written && err == nil {
+			t.Errorf("Test %d: expected rate limit error, got no error", i)
+		}
+		if w.Msg != nil && w.Msg.Truncated != tt.truncated {
+			t.Errorf("Test %d: expected truncated %v, got %v", i, tt.truncated, w.Msg.Truncated)
+		}
+		if rrl.tableFullLog.last == 0 {
+			t.Errorf("Test %d: expected table full to be logged", i)
+		}
+	}
+}
+
+func TestServeDNSAllocs(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.Zones = []string{"example.org."}
+	rrl.responsesInterval = 1 // effectively unlimited, so every response is written
+	rrl.nodataInterval = 1
+	rrl.initTable()
+
+	reqs, next := fixedBackend()
+	rrl.Next = next
+	w := &fixedWriter{addr: &net.UDPAddr{IP: net.ParseIP("10.240.0.1"), Port: 4321}}
+	ctx := context.TODO()
+
+	// create the accounts
+	for _, r := range reqs {
+		rrl.ServeDNS(ctx, w, r)
+	}
+
+	i := 0
+	allocs := testing.AllocsPerRun(100, func() {
+		rrl.ServeDNS(ctx, w, reqs[i%len(reqs)])
+		i++
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations serving responses to existing accounts, got %v", allocs)
+	}
+}
+
 func fixedAnswer(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	r.Answer = []dns.RR{test.A("example.com.	5	IN	A	1.2.3.4")}
 	w.WriteMsg(r)
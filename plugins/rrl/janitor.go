@@ -0,0 +1,33 @@
+package rrl
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// sweep removes the accounts that have fully recovered from the table, and reports the resulting table metrics
+// if a request has been served yet.
+func (rrl *RRL) sweep() {
+	n := rrl.table.Expire()
+	atomic.AddUint64(&rrl.stats.expired, uint64(n))
+	if server := rrl.stats.server.Load(); server != nil {
+		rrl.writeTableMetrics(*server)
+	}
+	if n > 0 {
+		log.Debugf("expired %d accounts", n)
+	}
+}
+
+// janitor periodically sweeps the table until stop is closed
+func (rrl *RRL) janitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(rrl.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			rrl.sweep()
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package rrl
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSweep(t *testing.T) {
+	const server = "dns://test-sweep:53"
+
+	rrl := defaultRRL()
+	rrl.window = second
+	rrl.maxTableSize = 1000
+	rrl.tableShards = 1
+	rrl.initTable()
+
+	now := time.Now().UnixNano()
+	for i := 0; i < 10; i++ {
+		// fully recovered accounts, used least recently
+		rrl.table.Add(testToken("stale"+strconv.Itoa(i)), &ResponseAccount{allowTime: now - 2*second})
+	}
+	for i := 0; i < 5; i++ {
+		rrl.table.Add(testToken("fresh"+strconv.Itoa(i)), &ResponseAccount{allowTime: now})
+	}
+
+	// metrics are not reported until a request has been served
+	rrl.sweep()
+	if l := rrl.table.Len(); l != 5 {
+		t.Fatalf("expected 5 accounts to remain, got %d", l)
+	}
+	if _, found := rrl.table.Get(testToken("fresh0")); !found {
+		t.Error("expected fresh account to remain")
+	}
+
+	rrl.reportTable(server, 1)
+	if v := testutil.ToFloat64(TableExpired.WithLabelValues(server)); v != 10 {
+		t.Errorf("expected 10 expired accounts, got %v", v)
+	}
+	if v := testutil.ToFloat64(TableOccupancy.WithLabelValues(server)); v != 0.005 {
+		t.Errorf("expected occupancy 0.005, got %v", v)
+	}
+
+	// once the server is known, the janitor reports after each sweep
+	rrl.table.Add(testToken("stale"), &ResponseAccount{allowTime: now - 2*second})
+	rrl.table.Add(testToken("fresh"), &ResponseAccount{allowTime: now})
+	rrl.sweep()
+	if v := testutil.ToFloat64(TableExpired.WithLabelValues(server)); v != 11 {
+		t.Errorf("expected 11 expired accounts, got %v", v)
+	}
+	if v := testutil.ToFloat64(TableSize.WithLabelValues(server)); v != 6 {
+		t.Errorf("expected table size 6, got %v", v)
+	}
+}
+
+func TestSweepBehindIndebted(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.window = second
+	rrl.tableShards = 1
+	rrl.maxTableSize = 4
+	rrl.initTable()
+
+	// an account pushed deep into debt that has gone quiet doesn't keep recovered accounts used after it
+	now := time.Now().UnixNano()
+	rrl.table.Add(testToken("indebted"), &ResponseAccount{allowTime: now + second})
+	for i := 0; i < 3; i++ {
+		rrl.table.Add(testToken("recovered"+strconv.Itoa(i)), &ResponseAccount{allowTime: now - 2*second})
+	}
+	if n := rrl.table.Expire(); n != 3 {
+		t.Errorf("expected 3 accounts to expire, got %d", n)
+	}
+	if _, found := rrl.table.Get(testToken("indebted")); !found {
+		t.Error("expected the indebted account to remain")
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.window = second
+	rrl.sweepInterval = 10 * time.Millisecond
+	rrl.initTable()
+	rrl.table.Add(testToken("stale"), &ResponseAccount{allowTime: time.Now().UnixNano() - 2*second})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		rrl.janitor(stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for rrl.table.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if l := rrl.table.Len(); l != 0 {
+		t.Errorf("expected the janitor to expire the stale account, %d accounts remain", l)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the janitor to stop")
+	}
+}
@@ -0,0 +1,120 @@
+package rrl
+
+import (
+	"container/heap"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Label sets for the client label of the exceeded metrics
+const (
+	labelIP     = iota // the client address
+	labelPrefix        // the client address prefix, as used for accounting
+	labelTop           // the prefix of the heaviest hitters, otherwise "other"
+)
+
+// otherLabel is the client label of clients that are not among the heaviest hitters
+const otherLabel = "other"
+
+// countExceeded increments the exceeded counter c for the client of the request, labelled as set by metrics-labels
+func (rrl *RRL) countExceeded(c *prometheus.CounterVec, state request.Request) {
+	switch rrl.metricsLabels {
+	case labelPrefix:
+		c.WithLabelValues(rrl.prefixLabel(clientIP(state.W))).Add(1)
+	case labelTop:
+		c.WithLabelValues(rrl.topClients.label(rrl.prefixLabel(clientIP(state.W)))).Add(1)
+	default:
+		c.WithLabelValues(state.IP()).Add(1)
+	}
+}
+
+// prefixLabel returns the address prefix of ip in CIDR notation
+func (rrl *RRL) prefixLabel(ip net.IP) string {
+	if ip.To4() != nil {
+		return prefixString(rrl.prefix(ip)) + "/" + strconv.Itoa(rrl.ipv4PrefixLength)
+	}
+	return prefixString(rrl.prefix(ip)) + "/" + strconv.Itoa(rrl.ipv6PrefixLength)
+}
+
+// topK tracks the k clients exceeding limits most often using the space-saving algorithm, so that the number of
+// client labels in the exceeded metrics stays bounded when an attacker spoofs many source addresses. A client is
+// labelled with its own prefix once it is seen again while still tracked; until then it is counted as "other".
+// When a labelled client is no longer tracked, its series are deleted.
+type topK struct {
+	k int
+
+	mu    sync.Mutex
+	items map[string]*topKItem
+	heap  topKHeap // least frequent first
+}
+
+type topKItem struct {
+	key      string
+	count    uint64
+	labelled bool
+	index    int
+}
+
+func newTopK(k int) *topK {
+	return &topK{k: k, items: make(map[string]*topKItem, k)}
+}
+
+// label counts an occurrence of key and returns the label it should be counted under
+func (t *topK) label(key string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if it, ok := t.items[key]; ok {
+		it.count++
+		it.labelled = true
+		heap.Fix(&t.heap, it.index)
+		return key
+	}
+	if len(t.heap) < t.k {
+		it := &topKItem{key: key, count: 1}
+		t.items[key] = it
+		heap.Push(&t.heap, it)
+		return otherLabel
+	}
+	// replace the least frequent client, inheriting its count as the error bound
+	it := t.heap[0]
+	delete(t.items, it.key)
+	if it.labelled {
+		RequestsExceeded.DeleteLabelValues(it.key)
+		ResponsesExceeded.DeleteLabelValues(it.key)
+	}
+	it.key = key
+	it.count++
+	it.labelled = false
+	t.items[key] = it
+	heap.Fix(&t.heap, 0)
+	return otherLabel
+}
+
+// topKHeap implements heap.Interface, ordered by count
+type topKHeap []*topKItem
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	it := x.(*topKItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,67 @@
+package rrl
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTopK(t *testing.T) {
+	tk := newTopK(2)
+
+	// clients are counted as other until seen again while tracked
+	if l := tk.label("a"); l != otherLabel {
+		t.Errorf("expected %q, got %q", otherLabel, l)
+	}
+	if l := tk.label("a"); l != "a" {
+		t.Errorf("expected %q, got %q", "a", l)
+	}
+	tk.label("a")
+	tk.label("b")
+	if l := tk.label("b"); l != "b" {
+		t.Errorf("expected %q, got %q", "b", l)
+	}
+
+	// a new client replaces the least frequent one, and is counted as other
+	if l := tk.label("c"); l != otherLabel {
+		t.Errorf("expected %q, got %q", otherLabel, l)
+	}
+	if _, ok := tk.items["b"]; ok {
+		t.Error("expected b to be replaced")
+	}
+	if l := tk.label("a"); l != "a" {
+		t.Errorf("expected %q, got %q", "a", l)
+	}
+	if len(tk.items) != 2 || len(tk.heap) != 2 {
+		t.Errorf("expected 2 tracked clients, got %d items, %d in heap", len(tk.items), len(tk.heap))
+	}
+}
+
+func TestCountExceeded(t *testing.T) {
+	tests := []struct {
+		labels   int
+		addr     string
+		expected string
+	}{
+		{labels: labelIP, addr: "10.1.2.3", expected: "10.1.2.3"},
+		{labels: labelPrefix, addr: "10.1.2.3", expected: "10.1.2.0/24"},
+		{labels: labelPrefix, addr: "2001:db8::1", expected: "2001:db8::/56"},
+		{labels: labelTop, addr: "10.1.2.3", expected: otherLabel},
+	}
+
+	for i, tc := range tests {
+		rrl := defaultRRL()
+		rrl.metricsLabels = tc.labels
+		rrl.topClients = newTopK(10)
+		state := request.Request{W: &test.ResponseWriter{RemoteIP: tc.addr}, Req: new(dns.Msg)}
+
+		before := testutil.ToFloat64(ResponsesExceeded.WithLabelValues(tc.expected))
+		rrl.countExceeded(ResponsesExceeded, state)
+		if after := testutil.ToFloat64(ResponsesExceeded.WithLabelValues(tc.expected)); after != before+1 {
+			t.Errorf("Test %d: expected label %q to be incremented", i, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package rrl
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/rrl/plugins/rrl/cidr"
+)
+
+// cidrFile is a list of networks read from a file. The list is swapped atomically when the file is reloaded,
+// so it can be read concurrently while being reloaded.
+type cidrFile struct {
+	path string
+	trie atomic.Pointer[cidr.Trie]
+
+	// mtime and size of the file when last read, only accessed by the reloading goroutine
+	mtime time.Time
+	size  int64
+}
+
+// newCIDRFile returns a cidrFile with the networks read from the file at path
+func newCIDRFile(path string) (*cidrFile, error) {
+	f := &cidrFile{path: path}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// contains returns true if ip is within any network in the list
+func (f *cidrFile) contains(ip net.IP) bool {
+	return f.trie.Load().Contains(ip)
+}
+
+// reload reads the file if it has changed since it was last read, and swaps in the new list.
+// It returns true if the list was swapped. If the file cannot be read or parsed, the current list is kept.
+func (f *cidrFile) reload() (bool, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if f.mtime.Equal(stat.ModTime()) && f.size == stat.Size() {
+		return false, nil
+	}
+
+	t, err := parseCIDRs(file)
+	if err != nil {
+		return false, err
+	}
+	f.trie.Store(t)
+	f.mtime = stat.ModTime()
+	f.size = stat.Size()
+	return true, nil
+}
+
+// parseCIDRs parses a list of networks, one CIDR or IP address per line. Blank lines and
+// comments starting with '#' are ignored.
+func parseCIDRs(r io.Reader) (*cidr.Trie, error) {
+	t := cidr.New()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		n, err := cidr.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		t.Insert(n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reloadLists periodically reloads the exempt and block files until stop is closed
+func (rrl *RRL) reloadLists(stop <-chan struct{}) {
+	ticker := time.NewTicker(rrl.listReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, f := range []*cidrFile{rrl.exemptFile, rrl.blockFile} {
+				if f == nil {
+					continue
+				}
+				changed, err := f.reload()
+				if err != nil {
+					log.Warningf("failed to reload %v, keeping the current list: %v", f.path, err)
+					continue
+				}
+				if changed {
+					log.Infof("reloaded %v with %d networks", f.path, f.trie.Load().Len())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package rrl
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	in := `# monitoring probes
+10.0.0.0/8
+192.168.1.1   # a single host
+
+2001:db8::/32
+`
+	tr, err := parseCIDRs(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if tr.Len() != 3 {
+		t.Errorf("expected %v networks, got %v", 3, tr.Len())
+	}
+	for _, ip := range []string{"10.1.2.3", "192.168.1.1", "2001:db8::53"} {
+		if !tr.Contains(net.ParseIP(ip)) {
+			t.Errorf("expected %v to be in the list", ip)
+		}
+	}
+
+	if _, err := parseCIDRs(strings.NewReader("10.0.0.0/8\nnot-a-network\n")); err == nil {
+		t.Errorf("expected error parsing invalid network")
+	}
+}
+
+func TestCIDRFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.txt")
+	if err := os.WriteFile(path, []byte("10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newCIDRFile(path)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !f.contains(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected 10.0.0.1 to be in the list")
+	}
+
+	// an unchanged file is not reloaded
+	changed, err := f.reload()
+	if changed || err != nil {
+		t.Errorf("expected unchanged file not to be reloaded, got changed=%v, err=%v", changed, err)
+	}
+
+	if err := os.WriteFile(path, []byte("172.16.0.0/12\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	changed, err = f.reload()
+	if !changed || err != nil {
+		t.Errorf("expected changed file to be reloaded, got changed=%v, err=%v", changed, err)
+	}
+	if f.contains(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected 10.0.0.1 not to be in the reloaded list")
+	}
+	if !f.contains(net.ParseIP("172.16.0.1")) {
+		t.Errorf("expected 172.16.0.1 to be in the reloaded list")
+	}
+
+	// an invalid file keeps the current list
+	if err := os.WriteFile(path, []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if _, err := f.reload(); err == nil {
+		t.Errorf("expected error reloading invalid file")
+	}
+	if !f.contains(net.ParseIP("172.16.0.1")) {
+		t.Errorf("expected 172.16.0.1 to still be in the list")
+	}
+}
@@ -1,6 +1,8 @@
 package rrl
 
 import (
+	"sync/atomic"
+
 	"github.com/coredns/coredns/plugin"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,4 +24,123 @@ var (
 		Name:      "responses_exceeded_total",
 		Help:      "Counter of responses exceeding QPS limit.",
 	}, []string{"client_ip"})
+
+	RequestsBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "requests_blocked_total",
+		Help:      "Counter of requests dropped because the client is in the block list.",
+	}, []string{"server"})
+
+	QPSScale = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "qps_scale",
+		Help:      "Factor by which per-second allowances are scaled down due to total query load.",
+	}, []string{"server"})
+
+	ResponsesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "responses_dropped_total",
+		Help:      "Counter of responses dropped for exceeding a limit.",
+	}, []string{"server", "zone", "rtype"})
+
+	ResponsesSlipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "responses_slipped_total",
+		Help:      "Counter of truncated responses slipped for exceeding a limit.",
+	}, []string{"server", "zone", "rtype"})
+
+	ResponsesAllowed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "responses_allowed_total",
+		Help:      "Counter of responses written to the client without limiting.",
+	}, []string{"server", "zone", "rtype"})
+
+	TableSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "table_size",
+		Help:      "Number of accounts in the table.",
+	}, []string{"server"})
+
+	TableMaxSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "table_max_size",
+		Help:      "Maximum number of accounts in the table.",
+	}, []string{"server"})
+
+	TableOccupancy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "table_occupancy",
+		Help:      "Ratio of the number of accounts in the table to the maximum.",
+	}, []string{"server"})
+
+	TableExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "table_expired_total",
+		Help:      "Counter of fully recovered accounts removed from the table by the janitor.",
+	}, []string{"server"})
+
+	TableEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "table_evictions_total",
+		Help:      "Counter of accounts evicted from the table to make room for new accounts.",
+	}, []string{"server"})
+
+	TableInsertFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "rrl",
+		Name:      "table_insert_failures_total",
+		Help:      "Counter of accounts that could not be added because the table was full.",
+	}, []string{"server"})
 )
+
+// tableStats tracks when the table metrics were last reported
+type tableStats struct {
+	sec       int64  // the unix second of the last report
+	evictions uint64 // evictions counted at the last report
+	expired   uint64 // accounts expired by the janitor, not yet reported
+
+	// server is the server label of the last report, used by the janitor to report between requests
+	server atomic.Pointer[string]
+}
+
+// reportTable updates the table metrics of server, at most once per second. The table is shared by all servers
+// of the rrl block, so evictions are attributed to the server that reports them.
+func (rrl *RRL) reportTable(server string, now int64) {
+	sec := atomic.LoadInt64(&rrl.stats.sec)
+	if now <= sec || !atomic.CompareAndSwapInt64(&rrl.stats.sec, sec, now) {
+		return
+	}
+	if s := rrl.stats.server.Load(); s == nil || *s != server {
+		s := server // copied, so that server does not escape when the label is unchanged
+		rrl.stats.server.Store(&s)
+	}
+	rrl.writeTableMetrics(server)
+}
+
+// writeTableMetrics updates the table metrics of server
+func (rrl *RRL) writeTableMetrics(server string) {
+	// the capacity of the table is split evenly across its shards, so it may differ from max-table-size
+	size, capacity := rrl.table.Len(), rrl.table.Cap()
+	TableSize.WithLabelValues(server).Set(float64(size))
+	TableMaxSize.WithLabelValues(server).Set(float64(capacity))
+	if capacity > 0 {
+		TableOccupancy.WithLabelValues(server).Set(float64(size) / float64(capacity))
+	}
+	evictions := rrl.table.Evictions()
+	if prev := atomic.SwapUint64(&rrl.stats.evictions, evictions); evictions > prev {
+		TableEvictions.WithLabelValues(server).Add(float64(evictions - prev))
+	}
+	if expired := atomic.SwapUint64(&rrl.stats.expired, 0); expired > 0 {
+		TableExpired.WithLabelValues(server).Add(float64(expired))
+	}
+}
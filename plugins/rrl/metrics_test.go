@@ -0,0 +1,103 @@
+package rrl
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/rrl/plugins/rrl/cache"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServeDNSResponseMetrics(t *testing.T) {
+	tc := test.Case{Qname: "example.com", Qtype: dns.TypeA, Rcode: dns.RcodeSuccess}
+
+	rrl := defaultRRL()
+	rrl.Next = test.HandlerFunc(fixedAnswer)
+	rrl.Zones = []string{"example.com."}
+	rrl.window = 2 * second
+	rrl.responsesInterval = second
+	rrl.slipRatio = 2
+	rrl.initTable()
+
+	allowed := testutil.ToFloat64(ResponsesAllowed.WithLabelValues("", "example.com.", "response"))
+	slipped := testutil.ToFloat64(ResponsesSlipped.WithLabelValues("", "example.com.", "response"))
+	dropped := testutil.ToFloat64(ResponsesDropped.WithLabelValues("", "example.com.", "response"))
+
+	// the first response is allowed, then the rest alternate between dropped and slipped
+	ctx := context.TODO()
+	for i := 0; i < 5; i++ {
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		rrl.ServeDNS(ctx, w, tc.Msg())
+	}
+
+	if d := testutil.ToFloat64(ResponsesAllowed.WithLabelValues("", "example.com.", "response")) - allowed; d != 1 {
+		t.Errorf("expected 1 allowed response, got %v", d)
+	}
+	if d := testutil.ToFloat64(ResponsesSlipped.WithLabelValues("", "example.com.", "response")) - slipped; d != 2 {
+		t.Errorf("expected 2 slipped responses, got %v", d)
+	}
+	if d := testutil.ToFloat64(ResponsesDropped.WithLabelValues("", "example.com.", "response")) - dropped; d != 2 {
+		t.Errorf("expected 2 dropped responses, got %v", d)
+	}
+}
+
+func TestReportTable(t *testing.T) {
+	const server = "dns://test-report-table:53"
+
+	rrl := defaultRRL()
+	rrl.maxTableSize = 1024
+	rrl.initTable()
+	// make every account evictable
+	rrl.table.SetEvict(func(*ResponseAccount) bool { return true })
+	for i := 0; i < 2000; i++ {
+		rrl.table.Add(testToken(strconv.Itoa(i)), &ResponseAccount{})
+	}
+
+	rrl.reportTable(server, 1)
+	size := rrl.table.Len()
+	if v := testutil.ToFloat64(TableSize.WithLabelValues(server)); v != float64(size) {
+		t.Errorf("expected table size %v, got %v", size, v)
+	}
+	if v := testutil.ToFloat64(TableMaxSize.WithLabelValues(server)); v != 1024 {
+		t.Errorf("expected table max size 1024, got %v", v)
+	}
+	if v := testutil.ToFloat64(TableEvictions.WithLabelValues(server)); v != float64(2000-size) {
+		t.Errorf("expected %v evictions, got %v", 2000-size, v)
+	}
+
+	// metrics are reported at most once per second
+	rrl.table.RemoveFunc(func(cache.Key, *ResponseAccount) bool { return true })
+	rrl.reportTable(server, 1)
+	if v := testutil.ToFloat64(TableSize.WithLabelValues(server)); v != float64(size) {
+		t.Errorf("expected table size %v, got %v", size, v)
+	}
+	rrl.reportTable(server, 2)
+	if v := testutil.ToFloat64(TableSize.WithLabelValues(server)); v != 0 {
+		t.Errorf("expected table size 0, got %v", v)
+	}
+}
+
+func TestReportTableCap(t *testing.T) {
+	const server = "dns://test-report-table-cap:53"
+
+	// each of the 256 default shards holds at least 4 accounts, so a small table holds more than max-table-size
+	rrl := defaultRRL()
+	rrl.maxTableSize = 100
+	rrl.initTable()
+	for i := 0; i < 512; i++ {
+		rrl.table.Add(testToken(strconv.Itoa(i)), &ResponseAccount{})
+	}
+
+	rrl.reportTable(server, 1)
+	if v := testutil.ToFloat64(TableMaxSize.WithLabelValues(server)); v != 1024 {
+		t.Errorf("expected table max size 1024, got %v", v)
+	}
+	size := rrl.table.Len()
+	if v := testutil.ToFloat64(TableOccupancy.WithLabelValues(server)); v != float64(size)/1024 || v > 1 {
+		t.Errorf("expected occupancy %v, got %v", float64(size)/1024, v)
+	}
+}
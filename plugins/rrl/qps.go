@@ -0,0 +1,55 @@
+package rrl
+
+import (
+	"sync/atomic"
+)
+
+// qpsMeter measures the total query rate of the plugin, one whole second at a time
+type qpsMeter struct {
+	sec   int64 // the unix second currently being counted
+	count int64 // queries counted so far in sec
+	rate  int64 // queries counted in the second before sec
+}
+
+// tick counts a query received at unix second now. It returns true if the query started a new second,
+// i.e. the measured rate has just been updated.
+func (m *qpsMeter) tick(now int64) bool {
+	sec := atomic.LoadInt64(&m.sec)
+	rolled := false
+	if now > sec && atomic.CompareAndSwapInt64(&m.sec, sec, now) {
+		count := atomic.SwapInt64(&m.count, 0)
+		if now != sec+1 {
+			// no queries were counted in the previous second
+			count = 0
+		}
+		atomic.StoreInt64(&m.rate, count)
+		rolled = true
+	}
+	atomic.AddInt64(&m.count, 1)
+	return rolled
+}
+
+// qps returns the query rate measured over the last whole second
+func (m *qpsMeter) qps() int64 {
+	return atomic.LoadInt64(&m.rate)
+}
+
+// scale returns the factor by which per-second allowances are currently scaled down.
+// The factor is 1 unless qps-scale is set and the measured query rate exceeds it.
+func (rrl *RRL) scale() float64 {
+	qps := rrl.qps.qps()
+	if rrl.qpsScale == 0 || qps <= rrl.qpsScale {
+		return 1
+	}
+	return float64(rrl.qpsScale) / float64(qps)
+}
+
+// scaleInterval returns the allowance interval adjusted by the current scale factor. Since intervals are
+// the inverse of per-second allowances, scaling down an allowance lengthens its interval.
+// A zero interval (no limit) is never scaled.
+func (rrl *RRL) scaleInterval(interval int64) int64 {
+	if interval <= 0 || rrl.qpsScale == 0 {
+		return interval
+	}
+	return int64(float64(interval) / rrl.scale())
+}
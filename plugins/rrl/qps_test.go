@@ -0,0 +1,58 @@
+package rrl
+
+import (
+	"testing"
+)
+
+func TestQPSMeter(t *testing.T) {
+	var m qpsMeter
+
+	if !m.tick(100) {
+		t.Errorf("expected first tick to start a new second")
+	}
+	for i := 0; i < 9; i++ {
+		if m.tick(100) {
+			t.Errorf("expected tick in the same second not to start a new second")
+		}
+	}
+	if m.qps() != 0 {
+		t.Errorf("expected qps %v, got %v", 0, m.qps())
+	}
+
+	// the rate is updated when the next second begins
+	if !m.tick(101) {
+		t.Errorf("expected tick to start a new second")
+	}
+	if m.qps() != 10 {
+		t.Errorf("expected qps %v, got %v", 10, m.qps())
+	}
+
+	// if a whole second passes without queries, the rate drops to zero
+	m.tick(103)
+	if m.qps() != 0 {
+		t.Errorf("expected qps %v, got %v", 0, m.qps())
+	}
+}
+
+func TestScaleInterval(t *testing.T) {
+	tests := []struct {
+		qpsScale, qps      int64
+		interval, expected int64
+	}{
+		{qpsScale: 0, qps: 1000, interval: second / 10, expected: second / 10},
+		{qpsScale: 250, qps: 100, interval: second / 10, expected: second / 10},
+		{qpsScale: 250, qps: 250, interval: second / 10, expected: second / 10},
+		{qpsScale: 250, qps: 1000, interval: second / 10, expected: second / 10 * 4},
+		{qpsScale: 250, qps: 1000, interval: 0, expected: 0},
+	}
+
+	for i, c := range tests {
+		rrl := defaultRRL()
+		rrl.qpsScale = c.qpsScale
+		rrl.qps.rate = c.qps
+		rrl.responsesInterval = c.interval
+		if got := rrl.scaleInterval(rrl.allowanceForRtype(rTypeResponse)); got != c.expected {
+			t.Errorf("Test %v: expected interval %v, got %v", i, c.expected, got)
+		}
+	}
+}
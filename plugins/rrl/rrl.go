@@ -6,10 +6,12 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin/metadata"
 	"github.com/coredns/rrl/plugins/rrl/cache"
+	"github.com/coredns/rrl/plugins/rrl/cidr"
 
 	"github.com/miekg/dns"
 
@@ -22,32 +24,141 @@ type RRL struct {
 	Next  plugin.Handler
 	Zones []string
 
-	window int64
+	// policy is the default policy, applied to responses in zones that have no policy of their own
+	policy
+
+	// zonePolicies holds the policies set in zone blocks, indexed by zone
+	zonePolicies map[string]*policy
+	policyZones  []string
 
 	ipv4PrefixLength int
 	ipv6PrefixLength int
 
+	allInterval int64
+
+	maxAmplification float64
+
+	requestsInterval int64
+
+	qpsScale int64
+	qps      qpsMeter
+
+	reportOnly bool
+
+	maxTableSize  int
+	tableShards   int
+	tableMode     uint8
+	sweepInterval time.Duration
+
+	exemptClients *cidr.Trie
+	exemptFile    *cidrFile
+	blockFile     *cidrFile
+	listReload    time.Duration
+
+	stateFile string
+
+	adminAddr string
+
+	dropLog *dropLogger
+
+	metricsLabels int
+	topClients    *topK
+
+	table        Store
+	newStore     func(StoreOptions) (Store, error) // creates the table, a local store if nil
+	debits       DebitObserver                     // the table, if it observes debits
+	sketch       *sketch                           // debited instead of the table, in table-mode sketch
+	stats        *tableStats
+	tableFullLog tableFullLog
+}
+
+// policy holds the response rate limiting parameters for a zone
+type policy struct {
+	window int64
+
 	responsesInterval int64
 	nodataInterval    int64
 	nxdomainsInterval int64
 	referralsInterval int64
 	errorsInterval    int64
 
-	requestsInterval int64
+	// qtypeIntervals holds the intervals of positive responses to specific qtypes, overriding responsesInterval
+	qtypeIntervals map[uint16]int64
 
-	slipRatio uint
+	// bytesPerSecond holds the response size budgets of response types that are accounted by size rather than count
+	bytesPerSecond map[uint8]int64
 
-	reportOnly bool
+	// bursts holds the number of responses (or bytes, for types accounted by size) that an account of a response type
+	// can save up, when more than one second of them
+	bursts map[uint8]int64
+
+	// sustained holds the second, longer term limits of response types
+	sustained map[uint8]sustainedLimit
 
-	maxTableSize int
+	slipRatio uint32
+
+	// onTableFull is the action taken on a response when its account cannot be added to the full table
+	onTableFull uint8
+}
 
-	table *cache.Cache
+// sustainedLimit limits the rate of responses averaged over a period, in addition to the per-second allowance. It is
+// accounted in a second bucket of each account, which holds up to the period of credit.
+type sustainedLimit struct {
+	interval int64 // the interval between responses at the sustained rate
+	period   int64 // the period the rate is averaged over
 }
 
-// ResponseAccount holds accounting for a category of response
+// ResponseAccount holds accounting for a category of response. Accounts looked up with Use are debited after the
+// lock of their shard is released, so allowTime, slipCountdown and sustainedAllowTime are always accessed atomically,
+// even while the shard is write locked. The byte counters of amplification accounts are only accessed from
+// UpdateAdd or Range, while the shard is locked.
 type ResponseAccount struct {
-	allowTime     int64 // Next response is allowed if current time >= allowTime
-	slipCountdown uint  // When at 1, a dropped response slips through instead of being dropped
+	allowTime     int64  // Next response is allowed if current time >= allowTime
+	slipCountdown uint32 // When at 1, a dropped response slips through instead of being dropped
+
+	// sustainedAllowTime is the allowTime of the sustained bucket, or 0 if the response type has no sustained limit
+	sustainedAllowTime int64
+
+	// Byte counters used for amplification accounts only, decayed over the window
+	requestBytes   int64
+	responseBytes  int64
+	amplifiedSince int64 // Time the amplification factor went above max-amplification, or 0 if it is not above
+}
+
+// AccountState is a copy of the state of a ResponseAccount, for stores that keep accounts outside of this package,
+// e.g. in a shared database. Times are in Unix nanoseconds.
+type AccountState struct {
+	AllowTime          int64  // the next response is allowed if the current time is at or after AllowTime
+	SlipCountdown      uint32 // when at 1, a dropped response slips through instead of being dropped
+	SustainedAllowTime int64  // the AllowTime of the sustained bucket, or 0 if there is no sustained limit
+
+	RequestBytes   int64 // the bytes of requests of an amplification account, decayed over the window
+	ResponseBytes  int64 // the bytes of responses of an amplification account, decayed over the window
+	AmplifiedSince int64 // the time the amplification factor went above max-amplification, or 0 if it is not above
+}
+
+// Snapshot returns a copy of the state of ra. The byte counters of amplification accounts are only updated while the
+// account's shard is write locked, so they are only consistent when Snapshot is called from Range or UpdateAdd.
+func (ra *ResponseAccount) Snapshot() AccountState {
+	return AccountState{
+		AllowTime:          atomic.LoadInt64(&ra.allowTime),
+		SlipCountdown:      atomic.LoadUint32(&ra.slipCountdown),
+		SustainedAllowTime: atomic.LoadInt64(&ra.sustainedAllowTime),
+		RequestBytes:       ra.requestBytes,
+		ResponseBytes:      ra.responseBytes,
+		AmplifiedSince:     ra.amplifiedSince,
+	}
+}
+
+// Restore sets the state of ra to s, e.g. to add an account read from a shared database with `new(ResponseAccount)`.
+// Accounts in a store must only be restored from UpdateAdd.
+func (ra *ResponseAccount) Restore(s AccountState) {
+	atomic.StoreInt64(&ra.allowTime, s.AllowTime)
+	atomic.StoreUint32(&ra.slipCountdown, s.SlipCountdown)
+	atomic.StoreInt64(&ra.sustainedAllowTime, s.SustainedAllowTime)
+	ra.requestBytes = s.RequestBytes
+	ra.responseBytes = s.ResponseBytes
+	ra.amplifiedSince = s.AmplifiedSince
 }
 
 // Theses constants are categories of response types
@@ -57,6 +168,13 @@ const (
 	rTypeNxdomain = 2
 	rTypeReferral = 3
 	rTypeError    = 4
+
+	// rTypeAll is not a response type, it is the category of all responses to a client
+	rTypeAll = 5
+	// rTypeAmplification is not a response type, it is the category tracking the amplification factor of a client
+	rTypeAmplification = 6
+	// rTypeRequest is not a response type, it is the category of requests from a client
+	rTypeRequest = 7
 )
 
 // responseType returns the RRL response type for a response
@@ -76,37 +194,178 @@ func responseType(m *dns.Msg) byte {
 }
 
 // allowanceForRtype returns allowed response interval for the given rtype
-func (rrl *RRL) allowanceForRtype(rtype uint8) int64 {
+func (p *policy) allowanceForRtype(rtype uint8) int64 {
 	switch rtype {
 	case rTypeResponse:
-		return rrl.responsesInterval
+		return p.responsesInterval
 	case rTypeNodata:
-		return rrl.nodataInterval
+		return p.nodataInterval
 	case rTypeNxdomain:
-		return rrl.nxdomainsInterval
+		return p.nxdomainsInterval
 	case rTypeReferral:
-		return rrl.referralsInterval
+		return p.referralsInterval
 	case rTypeError:
-		return rrl.errorsInterval
+		return p.errorsInterval
 	}
 	return -1
 }
 
-// initTable creates a new cache table and sets the cache eviction function
-func (rrl *RRL) initTable() {
-	rrl.table = cache.New(rrl.maxTableSize)
-	// This eviction function returns true if the allowance is >= max value (window)
-	rrl.table.SetEvict(func(el interface{}) bool {
-		ra, ok := el.(*ResponseAccount)
-		if !ok {
-			return true
+// allowanceForQtype returns allowed response interval for the given rtype and qtype.  Positive responses
+// to a qtype that has an allowance of its own use it instead of the allowance for the rtype.
+func (p *policy) allowanceForQtype(rtype uint8, qtype uint16) int64 {
+	if rtype == rTypeResponse {
+		if i, ok := p.qtypeIntervals[qtype]; ok {
+			return i
 		}
-		return time.Now().UnixNano()-ra.allowTime >= rrl.window
+	}
+	return p.allowanceForRtype(rtype)
+}
+
+// allowanceForResponse returns the interval to debit for a response of the given rtype, qtype and packed size.
+// Response types with a bytes-per-second budget are debited in proportion to the size of the response,
+// all others are debited per the allowance for the rtype and qtype.
+func (p *policy) allowanceForResponse(rtype uint8, qtype uint16, size int) int64 {
+	if bps, ok := p.bytesPerSecond[rtype]; ok {
+		if bps == 0 {
+			return 0
+		}
+		return int64(size) * second / bps
+	}
+	return p.allowanceForQtype(rtype, qtype)
+}
+
+// creditForQtype returns the most credit an account of the given rtype and qtype can hold. It is one second,
+// unless the rtype has a burst worth more.
+func (p *policy) creditForQtype(rtype uint8, qtype uint16) int64 {
+	n, ok := p.bursts[rtype]
+	if !ok {
+		return second
+	}
+	var credit int64
+	if bps, ok := p.bytesPerSecond[rtype]; ok {
+		if bps > 0 {
+			credit = n * second / bps
+		}
+	} else {
+		credit = n * p.allowanceForQtype(rtype, qtype)
+	}
+	return max(credit, second)
+}
+
+// maxCredit returns the most credit an account of any rtype or qtype can hold
+func (p *policy) maxCredit() int64 {
+	credit := int64(second)
+	for rtype := range p.bursts {
+		credit = max(credit, p.creditForQtype(rtype, 0))
+		if rtype == rTypeResponse {
+			for qtype := range p.qtypeIntervals {
+				credit = max(credit, p.creditForQtype(rtype, qtype))
+			}
+		}
+	}
+	return credit
+}
+
+// policyForZone returns the policy of the most specific zone block matching qname, or the default policy
+// if no zone block matches
+func (rrl *RRL) policyForZone(qname string) *policy {
+	if len(rrl.zonePolicies) == 0 {
+		return &rrl.policy
+	}
+	zone := matchZone(rrl.policyZones, qname)
+	if zone == "" {
+		return &rrl.policy
+	}
+	return rrl.zonePolicies[zone]
+}
+
+// maxWindow returns the longest window of all policies
+func (rrl *RRL) maxWindow() int64 {
+	w := rrl.window
+	for _, p := range rrl.zonePolicies {
+		if p.window > w {
+			w = p.window
+		}
+	}
+	return w
+}
+
+// maxCredit returns the most credit an account of any policy can hold
+func (rrl *RRL) maxCredit() int64 {
+	credit := rrl.policy.maxCredit()
+	for _, p := range rrl.zonePolicies {
+		credit = max(credit, p.maxCredit())
+	}
+	return credit
+}
+
+// maxSustainedPeriod returns the longest sustained period of all policies, or 0 if none has a sustained limit
+func (rrl *RRL) maxSustainedPeriod() int64 {
+	var period int64
+	for _, s := range rrl.sustained {
+		period = max(period, s.period)
+	}
+	for _, p := range rrl.zonePolicies {
+		for _, s := range p.sustained {
+			period = max(period, s.period)
+		}
+	}
+	return period
+}
+
+// expiredFunc returns a function that returns true if an account has recovered at time now, so that it may be
+// removed. Accounts are shared by policies, so none may be removed until it is beyond the longest window, nor before
+// it has earned back the most credit it can hold in each bucket, since a new account starts with it.
+func (rrl *RRL) expiredFunc() func(ra *ResponseAccount, now int64) bool {
+	window := rrl.maxWindow()
+	expire := max(window, rrl.maxCredit())
+	sustainedExpire := max(window, rrl.maxSustainedPeriod())
+	return func(ra *ResponseAccount, now int64) bool {
+		return now-atomic.LoadInt64(&ra.allowTime) >= expire && now-atomic.LoadInt64(&ra.sustainedAllowTime) >= sustainedExpire
+	}
+}
+
+// exempt returns true if the client ip is exempt from rate limiting
+func (rrl *RRL) exempt(ip net.IP) bool {
+	if rrl.exemptClients != nil && rrl.exemptClients.Contains(ip) {
+		return true
+	}
+	return rrl.exemptFile != nil && rrl.exemptFile.contains(ip)
+}
+
+// blocked returns true if the client ip is in the block list
+func (rrl *RRL) blocked(ip net.IP) bool {
+	return rrl.blockFile != nil && rrl.blockFile.contains(ip)
+}
+
+// initTable creates the table of accounts and sets its eviction function
+func (rrl *RRL) initTable() error {
+	window := rrl.maxWindow()
+	credit := rrl.maxCredit()
+	newStore := rrl.newStore
+	if newStore == nil {
+		newStore = newLocalStore
+	}
+	table, err := newStore(StoreOptions{MaxSize: rrl.maxTableSize, Shards: rrl.tableShards, Window: window, MaxCredit: credit, SlipRatio: rrl.slipRatio})
+	if err != nil {
+		return err
+	}
+	rrl.table = table
+	rrl.debits, _ = table.(DebitObserver)
+	if rrl.tableMode == tableModeSketch {
+		rrl.sketch = newSketch(rrl.maxTableSize, rrl.maxSustainedPeriod() != 0)
+	}
+	rrl.stats = &tableStats{}
+	// This eviction function returns true if the allowance is >= max value (window, or the most credit)
+	expired := rrl.expiredFunc()
+	rrl.table.SetEvict(func(ra *ResponseAccount) bool {
+		return expired(ra, time.Now().UnixNano())
 	})
+	return nil
 }
 
-// responseToToken returns a token string for the response in writer
-func (rrl *RRL) responseToToken(ctx context.Context, nw *nonwriter.Writer, rtype byte) string {
+// responseToToken returns a token for the response in writer
+func (rrl *RRL) responseToToken(ctx context.Context, nw *nonwriter.Writer, rtype byte, ip net.IP) cache.Key {
 	var name string
 	if rtype == rTypeNxdomain || rtype == rTypeReferral {
 		// for these types we index on the authoritative domain, not the full qname
@@ -122,106 +381,339 @@ func (rrl *RRL) responseToToken(ctx context.Context, nw *nonwriter.Writer, rtype
 			name = nw.Msg.Question[0].Name
 		}
 	}
-	return rrl.buildToken(rtype, nw.Msg.Question[0].Qtype, name, nw.RemoteAddr().String())
+	return rrl.buildToken(rtype, nw.Msg.Question[0].Qtype, name, ip)
 }
 
-// buildToken returns a token string for the given inputs
-func (rrl *RRL) buildToken(rtype uint8, qtype uint16, name, remoteAddr string) string {
+// buildToken returns a token for the given inputs
+func (rrl *RRL) buildToken(rtype uint8, qtype uint16, name string, ip net.IP) cache.Key {
 	// "Per BIND" references below are copied from the BIND 9.11 Manual
 	// https://ftp.isc.org/isc/bind9/cur/9.11/doc/arm/Bv9ARM.pdf
-	prefix := rrl.addrPrefix(remoteAddr)
-	rtypestr := strconv.FormatUint(uint64(rtype), 10)
+	t := cache.Key{Prefix: rrl.prefix(ip), Type: rtype}
 	switch rtype {
 	case rTypeResponse:
 		// Per BIND: All non-empty responses for a valid domain name (qname) and record type (qtype) are identical
-		qtypeStr := strconv.FormatUint(uint64(qtype), 10)
-		return strings.Join([]string{prefix, rtypestr, qtypeStr, name}, "/")
+		t.Qtype = qtype
+		t.Name = hashName(name)
 	case rTypeNodata:
 		// Per BIND: All empty (NODATA) responses for a valid domain, regardless of query type, are identical.
-		return strings.Join([]string{prefix, rtypestr, "", name}, "/")
+		t.Name = hashName(name)
 	case rTypeNxdomain:
 		// Per BIND: Requests for any and all undefined subdomains of a given valid domain result in NXDOMAIN errors
 		// and are identical regardless of query type.
-		return strings.Join([]string{prefix, rtypestr, "", name}, "/")
+		t.Name = hashName(name)
 	case rTypeReferral:
 		// Per BIND: Referrals or delegations to the server of a given domain are identical.
-		qtypeStr := strconv.FormatUint(uint64(qtype), 10)
-		return strings.Join([]string{prefix, rtypestr, qtypeStr, name}, "/")
+		t.Qtype = qtype
+		t.Name = hashName(name)
 	case rTypeError:
 		// Per BIND: All requests that result in DNS errors other than NXDOMAIN, such as SERVFAIL and FORMERR, are
 		// identical regardless of requested name (qname) or record type (qtype).
-		return strings.Join([]string{prefix, rtypestr, "", ""}, "/")
+	case rTypeAll:
+		// Per BIND: all-per-second limits all responses sent to a client prefix, regardless of the
+		// response type, qname or qtype.
+	case rTypeAmplification:
+		// The amplification factor is tracked over all responses sent to a client prefix
+	case rTypeRequest:
+		// Requests are limited per client prefix
+	}
+	return t
+}
+
+// hashName returns the case insensitive FNV-1a hash of name, or 0 if name is empty
+func hashName(name string) uint64 {
+	if name == "" {
+		return 0
+	}
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		h ^= uint64(c)
+		h *= 1099511628211
 	}
-	return ""
+	return h
+}
+
+// tokenString returns the text form of token t, prefix/rtype/qtype/name, where qtype and name are omitted
+// when the token is not indexed by them, and name is the hexadecimal hash of the name.
+func tokenString(t cache.Key) string {
+	var sb strings.Builder
+	sb.WriteString(prefixString(t.Prefix))
+	sb.WriteByte('/')
+	sb.WriteString(strconv.FormatUint(uint64(t.Type), 10))
+	sb.WriteByte('/')
+	if t.Qtype != 0 {
+		sb.WriteString(strconv.FormatUint(uint64(t.Qtype), 10))
+	}
+	sb.WriteByte('/')
+	if t.Name != 0 {
+		sb.WriteString(strconv.FormatUint(t.Name, 16))
+	}
+	return sb.String()
+}
+
+// parseTokenString parses the text form of a token, as returned by tokenString
+func parseTokenString(s string) (cache.Key, error) {
+	var t cache.Key
+	fields := strings.Split(s, "/")
+	if len(fields) != 4 {
+		return t, errors.New("invalid token '" + s + "'")
+	}
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		return t, errors.New("invalid token prefix '" + fields[0] + "'")
+	}
+	copy(t.Prefix[:], ip.To16())
+	rtype, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return t, errors.New("invalid token type '" + fields[1] + "'")
+	}
+	t.Type = uint8(rtype)
+	if fields[2] != "" {
+		qtype, err := strconv.ParseUint(fields[2], 10, 16)
+		if err != nil {
+			return t, errors.New("invalid token qtype '" + fields[2] + "'")
+		}
+		t.Qtype = uint16(qtype)
+	}
+	if fields[3] != "" {
+		if t.Name, err = strconv.ParseUint(fields[3], 16, 64); err != nil {
+			return t, errors.New("invalid token name '" + fields[3] + "'")
+		}
+	}
+	return t, nil
 }
 
 // debit will update an existing response account in the rrl table and recalculate the current balance,
-// or if the response account does not exist, it will add it.
-func (rrl *RRL) debit(allowance int64, t string) (int64, bool, error) {
+// or if the response account does not exist, it will add it. The window and slip ratio of policy p apply.
+func (rrl *RRL) debit(p *policy, allowance int64, t cache.Key) (int64, bool, error) {
+	if rrl.sketch != nil {
+		balance, slip := rrl.sketch.debit(p, allowance, t, time.Now().UnixNano())
+		return balance, slip, nil
+	}
 
-	type balances struct {
+	// existing accounts are updated atomically, so only the read lock of the shard is taken. A response larger than
+	// the bytes-per-second budget costs more than the credit, which is raised to its cost so that it can be allowed
+	// once the account has fully recovered.
+	credit := max(p.creditForQtype(t.Type, t.Qtype), allowance)
+	now := time.Now().UnixNano()
+	if ra, found := rrl.table.Use(t); found {
+		balance, slip := ra.debit(p, t.Type, allowance, credit, now)
+		if rrl.debits != nil {
+			rrl.debits.Debited(t, allowance)
+		}
+		return balance, slip, nil
+	}
+
+	// results are set by the 'update' function, while the account is locked
+	var (
 		balance int64
 		slip    bool
+	)
+	_, err := rrl.table.UpdateAdd(t,
+		// the 'update' function updates an account added since it was looked up
+		func(ra *ResponseAccount) *ResponseAccount {
+			balance, slip = ra.debit(p, t.Type, allowance, credit, now)
+			return ra
+		},
+		// the 'add' function returns a new ResponseAccount for the response type, with all of its credit
+		func() *ResponseAccount {
+			ra := &ResponseAccount{
+				allowTime:     now - credit + allowance,
+				slipCountdown: p.slipRatio,
+			}
+			if s, ok := p.sustained[t.Type]; ok {
+				ra.sustainedAllowTime = now - s.period + s.interval
+			}
+			return ra
+		})
+
+	if err != nil {
+		return 0, false, err
+	}
+	if rrl.debits != nil {
+		rrl.debits.Debited(t, allowance)
 	}
-	result := rrl.table.UpdateAdd(t,
-		// the 'update' function updates the account and returns the new balance
-		func(el interface{}) interface{} {
-			if el == nil {
-				return nil
+	return balance, slip, nil
+}
+
+// debit debits allowance from the account of a response type at time now, and returns the new balance, and whether
+// a limited response should slip. If the response type has a sustained limit, a response is also debited from the
+// sustained bucket, and the balance is the lower of the two, so that a response is limited when either bucket is
+// exhausted. The account is updated with compare-and-swap, so that it can be debited concurrently.
+func (ra *ResponseAccount) debit(p *policy, rtype uint8, allowance, credit, now int64) (int64, bool) {
+	balance := draw(&ra.allowTime, allowance, credit, p.window, now)
+	if s, ok := p.sustained[rtype]; ok {
+		balance = min(balance, draw(&ra.sustainedAllowTime, s.interval, s.period, p.window, now))
+	}
+	if balance > 0 {
+		return balance, false
+	}
+	return balance, slip(&ra.slipCountdown, p.slipRatio)
+}
+
+// draw debits allowance from the bucket of allowTime with compare-and-swap, and returns the new balance at time now.
+// The balance can't exceed credit, nor be more negative than window.
+func draw(allowTimeAddr *int64, allowance, credit, window, now int64) int64 {
+	for {
+		allowTime := atomic.LoadInt64(allowTimeAddr)
+		balance := now - allowTime - allowance
+		if balance >= credit {
+			// positive balance can't exceed the credit, 1 second unless raised by burst
+			balance = credit - allowance
+		} else if balance < -window {
+			// balance can't be more negative than window
+			balance = -window
+		}
+		if atomic.CompareAndSwapInt64(allowTimeAddr, allowTime, now-balance) {
+			return balance
+		}
+	}
+}
+
+// slip counts down a limited response with compare-and-swap, and returns true if it should slip. The countdown
+// restarts at ratio when it reaches 1, and never slips when it is 0.
+func slip(countdown *uint32, ratio uint32) bool {
+	for {
+		c := atomic.LoadUint32(countdown)
+		if c == 0 {
+			return false
+		}
+		if c == 1 {
+			if atomic.CompareAndSwapUint32(countdown, c, ratio) {
+				return true
 			}
-			ra := el.(*ResponseAccount)
+			continue
+		}
+		if atomic.CompareAndSwapUint32(countdown, c, c-1) {
+			return false
+		}
+	}
+}
+
+// amplified will update the byte counters of an existing amplification account in the rrl table, or if the account
+// does not exist, it will add it.  It returns true if the ratio of response bytes to request bytes has been above
+// max-amplification for at least the window, and whether a limited response should slip.
+func (rrl *RRL) amplified(t cache.Key, reqSize, respSize int) (bool, bool, error) {
+	// results are set by the 'update' function, while the account is locked
+	var limited, slipped bool
+	_, err := rrl.table.UpdateAdd(t,
+		// the 'update' function decays and adds to the byte counters, and sets whether the client is limited
+		func(ra *ResponseAccount) *ResponseAccount {
 			now := time.Now().UnixNano()
-			balance := now - ra.allowTime - allowance
-			if balance >= second {
-				// positive balance can't exceed 1 second
-				balance = second - allowance
-			} else if balance < -rrl.window {
-				// balance can't be more negative than window
-				balance = -rrl.window
+			if elapsed := now - atomic.LoadInt64(&ra.allowTime); elapsed >= rrl.window {
+				// counters are stale, start over
+				ra.requestBytes, ra.responseBytes = 0, 0
+			} else if elapsed > 0 {
+				// linearly decay counters so they approximate the bytes sent over the last window
+				decay := float64(rrl.window-elapsed) / float64(rrl.window)
+				ra.requestBytes = int64(float64(ra.requestBytes) * decay)
+				ra.responseBytes = int64(float64(ra.responseBytes) * decay)
 			}
-			ra.allowTime = now - balance
-			if balance > 0 || ra.slipCountdown == 0 {
-				return balances{balance, false}
+			atomic.StoreInt64(&ra.allowTime, now) // last seen, so the account is evicted once idle for the window
+			ra.requestBytes += int64(reqSize)
+			ra.responseBytes += int64(respSize)
+
+			if float64(ra.responseBytes) <= rrl.maxAmplification*float64(ra.requestBytes) {
+				ra.amplifiedSince = 0
+				return ra
 			}
-			if ra.slipCountdown == 1 {
-				ra.slipCountdown = rrl.slipRatio
-				return balances{balance, true}
+			if ra.amplifiedSince == 0 {
+				ra.amplifiedSince = now
 			}
-			ra.slipCountdown -= 1
-			return balances{balance, false}
-
+			if now-ra.amplifiedSince < rrl.window {
+				return ra
+			}
+			limited = true
+			slipped = slip(&ra.slipCountdown, rrl.slipRatio)
+			return ra
 		},
-		// the 'add' function returns a new ResponseAccount for the response type
-		func() interface{} {
+		// the 'add' function returns a new ResponseAccount holding the byte counts of the first response
+		func() *ResponseAccount {
+			now := time.Now().UnixNano()
 			ra := &ResponseAccount{
-				allowTime:     time.Now().UnixNano() - second + allowance,
+				allowTime:     now,
 				slipCountdown: rrl.slipRatio,
+				requestBytes:  int64(reqSize),
+				responseBytes: int64(respSize),
+			}
+			if float64(respSize) > rrl.maxAmplification*float64(reqSize) {
+				ra.amplifiedSince = now
 			}
 			return ra
 		})
 
-	if result == nil {
-		return 0, false, nil
+	if err != nil {
+		return false, false, err
 	}
-	if err, ok := result.(error); ok {
-		return 0, false, err
+	return limited, slipped, nil
+}
+
+// matchZone returns the longest zone in zones that qname is equal to, or a subdomain of, or "" if there is none.
+// It is equivalent to plugin.Zones.Matches, without allocating. The zones and qname must be lower case and fully
+// qualified.
+func matchZone(zones []string, qname string) string {
+	match := ""
+	for _, z := range zones {
+		if len(z) <= len(match) {
+			continue
+		}
+		if z == "." || qname == z || (strings.HasSuffix(qname, z) && qname[len(qname)-len(z)-1] == '.') {
+			match = z
+		}
 	}
-	if b, ok := result.(balances); ok {
-		return b.balance, b.slip, nil
+	return match
+}
+
+// clientIP returns the address of the client of w. The address is taken from the net.Addr when possible, to avoid
+// parsing its text form.
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return nil
 	}
-	return 0, false, errors.New("unexpected result type")
+	return net.ParseIP(host)
 }
 
-// addrPrefix returns the address prefix of the net.Addr style address string (e.g. 1.2.3.4:1234 or [1:2::3:4]:1234)
-func (rrl *RRL) addrPrefix(addr string) string {
-	i := strings.LastIndex(addr, ":")
-	ip := net.ParseIP(addr[:i])
-	if ip.To4() != nil {
-		ip = ip.Mask(net.CIDRMask(rrl.ipv4PrefixLength, 32))
-		return ip.String()
+// prefix returns the address prefix of ip in 16 byte form, with IPv4 prefixes in IPv4-mapped IPv6 form
+func (rrl *RRL) prefix(ip net.IP) [16]byte {
+	var p [16]byte
+	if ip4 := ip.To4(); ip4 != nil {
+		p[10], p[11] = 0xff, 0xff
+		maskBytes(p[12:], ip4, rrl.ipv4PrefixLength)
+		return p
 	}
-	ip = net.ParseIP(addr[1 : i-1]) // strip brackets from ipv6 e.g. [2001:db8::1]
-	ip = ip.Mask(net.CIDRMask(rrl.ipv6PrefixLength, 128))
+	if ip16 := ip.To16(); ip16 != nil {
+		maskBytes(p[:], ip16, rrl.ipv6PrefixLength)
+	}
+	return p
+}
+
+// maskBytes copies the first ones bits of src to dst
+func maskBytes(dst, src []byte, ones int) {
+	for i := range dst {
+		switch {
+		case ones >= 8:
+			dst[i] = src[i]
+			ones -= 8
+		case ones > 0:
+			dst[i] = src[i] &^ (0xff >> ones)
+			ones = 0
+		default:
+			return
+		}
+	}
+}
 
-	return ip.String()
+// prefixString returns the text form of address prefix p
+func prefixString(p [16]byte) string {
+	return net.IP(p[:]).String()
 }
@@ -2,11 +2,13 @@ package rrl
 
 import (
 	"context"
+	"net"
 	"strconv"
 	"testing"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/rrl/plugins/rrl/cache"
 	"github.com/miekg/dns"
 )
 
@@ -15,38 +17,71 @@ func BenchmarkBuildToken(b *testing.B) {
 		ipv4PrefixLength: 24,
 		ipv6PrefixLength: 56,
 	}
+	ip := net.ParseIP("101.102.103.104")
 	b.ReportAllocs()
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
-		rrl.buildToken(rTypeResponse, dns.TypeA, "example.org.", "101.102.103.104:4321")
+		rrl.buildToken(rTypeResponse, dns.TypeA, "example.org.", ip)
 	}
 }
 
 func BenchmarkDebit(b *testing.B) {
 	rrl := RRL{
-		window:            15 * second,
-		responsesInterval: second / 10,
-		maxTableSize:      10000,
+		policy: policy{
+			window:            15 * second,
+			responsesInterval: second / 10,
+		},
+		maxTableSize: 10000,
+		tableShards:  cache.DefaultShards,
 	}
 	rrl.initTable()
+	ip := net.ParseIP("101.102.103.104")
+	tokens := make([]cache.Key, 10000)
+	for i := range tokens {
+		tokens[i] = rrl.buildToken(rTypeResponse, dns.TypeA, strconv.Itoa(i)+".example.org.", ip)
+	}
 	b.ReportAllocs()
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
-		rrl.debit(10, "0/0/101.102.103.0/"+strconv.Itoa(i%10000)+".example.org")
+		rrl.debit(&rrl.policy, 10, tokens[i%10000])
+	}
+}
+
+// BenchmarkDebitHotName debits a single account from all cores, as in a flood aimed at one name
+func BenchmarkDebitHotName(b *testing.B) {
+	rrl := RRL{
+		policy: policy{
+			window:            15 * second,
+			responsesInterval: second / 10,
+		},
+		maxTableSize: 10000,
+		tableShards:  cache.DefaultShards,
 	}
+	rrl.initTable()
+	token := rrl.buildToken(rTypeResponse, dns.TypeA, "example.org.", net.ParseIP("101.102.103.104"))
+	rrl.debit(&rrl.policy, 10, token)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rrl.debit(&rrl.policy, 10, token)
+		}
+	})
 }
 
 func BenchmarkServeDNS(b *testing.B) {
 	rrl := RRL{
-		Zones:             []string{"example.org."},
-		Next:              backendHandler(),
-		window:            15 * second,
-		ipv4PrefixLength:  24,
-		ipv6PrefixLength:  56,
-		responsesInterval: second / 10,
-		nxdomainsInterval: second / 10,
-		errorsInterval:    second / 10,
-		maxTableSize:      1000,
+		Zones: []string{"example.org."},
+		Next:  backendHandler(),
+		policy: policy{
+			window:            15 * second,
+			responsesInterval: second / 10,
+			nxdomainsInterval: second / 10,
+			errorsInterval:    second / 10,
+		},
+		ipv4PrefixLength: 24,
+		ipv6PrefixLength: 56,
+		maxTableSize:     1000,
+		tableShards:      cache.DefaultShards,
 	}
 	rrl.initTable()
 
@@ -112,3 +147,61 @@ func backendHandler() plugin.Handler {
 		return dns.RcodeSuccess, nil
 	})
 }
+
+// BenchmarkServeDNSHotPath measures ServeDNS for responses that are within limits, to accounts that already exist.
+// The backend and response writer do not allocate, so the allocations reported are those of rrl alone.
+func BenchmarkServeDNSHotPath(b *testing.B) {
+	rrl := defaultRRL()
+	rrl.Zones = []string{"example.org."}
+	rrl.responsesInterval = 1 // effectively unlimited, so every response is written
+	rrl.nodataInterval = 1
+	rrl.initTable()
+
+	reqs, next := fixedBackend()
+	rrl.Next = next
+	w := &fixedWriter{addr: &net.UDPAddr{IP: net.ParseIP("101.102.103.104"), Port: 4321}}
+	ctx := context.TODO()
+
+	// create the accounts
+	for _, r := range reqs {
+		rrl.ServeDNS(ctx, w, r)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rrl.ServeDNS(ctx, w, reqs[i%len(reqs)])
+	}
+}
+
+// fixedBackend returns requests, and a handler that answers them with prebuilt responses without allocating
+func fixedBackend() ([]*dns.Msg, plugin.Handler) {
+	var reqs []*dns.Msg
+	resps := make(map[*dns.Msg]*dns.Msg)
+	for _, q := range []string{"a", "b", "c", "d", "e", "f"} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			r := new(dns.Msg)
+			r.SetQuestion(q+".example.org.", qtype)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if qtype == dns.TypeA {
+				m.Answer = []dns.RR{test.A(q + ".example.org. 5 IN A 1.2.3.4")}
+			}
+			reqs = append(reqs, r)
+			resps[r] = m
+		}
+	}
+	return reqs, plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		w.WriteMsg(resps[r])
+		return dns.RcodeSuccess, nil
+	})
+}
+
+// fixedWriter is a response writer with a fixed remote address, that discards responses without allocating
+type fixedWriter struct {
+	test.ResponseWriter
+	addr net.Addr
+}
+
+func (w *fixedWriter) RemoteAddr() net.Addr      { return w.addr }
+func (w *fixedWriter) WriteMsg(m *dns.Msg) error { return nil }
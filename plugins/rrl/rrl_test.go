@@ -1,6 +1,10 @@
 package rrl
 
 import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -8,42 +12,305 @@ import (
 
 	"github.com/miekg/dns"
 
+	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/test"
 )
 
+// testToken returns a token indexed by name only, for tests that don't depend on the token
+func testToken(name string) cache.Key {
+	return cache.Key{Name: hashName(name)}
+}
+
 func TestDebit(t *testing.T) {
 
 	rrl := defaultRRL()
 	rrl.window = 5 * second
 	rrl.responsesInterval = second / 10
 	rrl.nxdomainsInterval = second / 100
-	rrl.table = cache.New(rrl.maxTableSize)
+	rrl.initTable()
 
-	_, _, err := rrl.debit(rrl.allowanceForRtype(rTypeResponse), "token1")
+	_, _, err := rrl.debit(&rrl.policy, rrl.allowanceForRtype(rTypeResponse), testToken("token1"))
 	if err != nil {
 		t.Errorf("got error: %v", err)
 	}
-	ra, _ := rrl.table.Get("token1")
-	bal := time.Now().UnixNano() - ra.(*ResponseAccount).allowTime
+	ra, _ := rrl.table.Get(testToken("token1"))
+	bal := time.Now().UnixNano() - ra.allowTime
 	if bal < second-rrl.responsesInterval {
 		t.Errorf("expected balance not less than %v, got %v", second-rrl.responsesInterval, bal)
 	}
 
-	bal, _, err = rrl.debit(rrl.allowanceForRtype(rTypeResponse), "token1")
+	bal, _, err = rrl.debit(&rrl.policy, rrl.allowanceForRtype(rTypeResponse), testToken("token1"))
 	if bal > second-rrl.responsesInterval {
 		t.Errorf("expected balance of < %v, got %v", second-rrl.responsesInterval, bal)
 	}
 
-	_, _, err = rrl.debit(rrl.allowanceForRtype(rTypeNxdomain), "token2")
+	_, _, err = rrl.debit(&rrl.policy, rrl.allowanceForRtype(rTypeNxdomain), testToken("token2"))
 	if err != nil {
 		t.Errorf("got error: %v", err)
 	}
 	time.Sleep(time.Second) // sleep 1 second, balance should max out
-	bal, _, err = rrl.debit(rrl.allowanceForRtype(rTypeNxdomain), "token2")
+	bal, _, err = rrl.debit(&rrl.policy, rrl.allowanceForRtype(rTypeNxdomain), testToken("token2"))
 	if bal != second-rrl.nxdomainsInterval {
 		t.Errorf("expected balance of %v, got %v", rrl.window-rrl.nxdomainsInterval, bal)
 	}
 
+	// a burst of 30 responses lets a new client use 3 seconds of credit at once
+	rrl.bursts = map[uint8]int64{rTypeResponse: 30}
+	token := cache.Key{Type: rTypeResponse, Name: hashName("token3")}
+	for i := 1; i <= 30; i++ {
+		bal, _, err = rrl.debit(&rrl.policy, rrl.responsesInterval, token)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if bal < 0 {
+			t.Fatalf("expected response %d of the burst to be allowed, got balance %v", i, bal)
+		}
+	}
+
+	// credit is earned back at the steady rate, so 1 second later, 10 more responses are allowed
+	ra, _ = rrl.table.Get(token)
+	atomic.AddInt64(&ra.allowTime, -second)
+	for i := 1; i <= 10; i++ {
+		if bal, _, _ = rrl.debit(&rrl.policy, rrl.responsesInterval, token); bal < 0 {
+			t.Fatalf("expected response %d after 1 second to be allowed, got balance %v", i, bal)
+		}
+	}
+	if bal, _, _ = rrl.debit(&rrl.policy, rrl.responsesInterval, token); bal >= 0 {
+		t.Errorf("expected the response after the refill to be limited, got balance %v", bal)
+	}
+
+	// and credit refills up to the burst, not beyond
+	atomic.AddInt64(&ra.allowTime, -10*second)
+	bal, _, _ = rrl.debit(&rrl.policy, rrl.responsesInterval, token)
+	if expected := 30*rrl.responsesInterval - rrl.responsesInterval; bal != expected {
+		t.Errorf("expected balance of %v, got %v", expected, bal)
+	}
+}
+
+// TestDebitLargerThanBudget debits responses larger than the bytes-per-second budget, which cost more than the
+// credit of an account, and are allowed again once the account has recovered their cost.
+func TestDebitLargerThanBudget(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.window = 5 * second
+	rrl.bytesPerSecond = map[uint8]int64{rTypeResponse: 1000}
+	rrl.initTable()
+
+	token := testToken("token1")
+	allowance := rrl.allowanceForResponse(rTypeResponse, dns.TypeA, 3000)
+	for i := 0; i < 3; i++ {
+		bal, _, err := rrl.debit(&rrl.policy, allowance, token)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if bal < 0 {
+			t.Errorf("Test %d: expected the response to be allowed, got balance %v", i, bal)
+		}
+		bal, _, _ = rrl.debit(&rrl.policy, allowance, token)
+		if bal >= 0 {
+			t.Errorf("Test %d: expected the next response to be limited, got balance %v", i, bal)
+		}
+
+		// the account recovers fully
+		ra, _ := rrl.table.Get(token)
+		atomic.StoreInt64(&ra.allowTime, time.Now().UnixNano()-rrl.window-allowance)
+	}
+}
+
+// TestExpireConcurrent expires accounts while they are debited, which the race detector checks are read atomically
+func TestExpireConcurrent(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.window = second
+	rrl.initTable()
+
+	token := testToken("token1")
+	rrl.debit(&rrl.policy, second/1000, token)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				rrl.debit(&rrl.policy, second/1000, token)
+			}
+		}
+	}()
+	for i := 0; i < 10000; i++ {
+		rrl.table.Expire()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestDebitConcurrent(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.window = 1000 * second
+	rrl.slipRatio = 2
+	rrl.initTable()
+
+	// an indebted account is debited exactly, as long as it stays within the window
+	token := testToken("token1")
+	allowTime := time.Now().UnixNano() + second
+	rrl.table.Add(token, &ResponseAccount{allowTime: allowTime, slipCountdown: 2})
+
+	const workers, debits = 8, 1000
+	slips := make(chan int, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := 0
+			for j := 0; j < debits; j++ {
+				if _, slip, _ := rrl.debit(&rrl.policy, second/1000, token); slip {
+					n++
+				}
+			}
+			slips <- n
+		}()
+	}
+	wg.Wait()
+	close(slips)
+
+	ra, _ := rrl.table.Get(token)
+	if expected := allowTime + workers*debits*(second/1000); ra.allowTime != expected {
+		t.Errorf("expected allowTime %v, got %v", expected, ra.allowTime)
+	}
+	n := 0
+	for s := range slips {
+		n += s
+	}
+	if n != workers*debits/2 {
+		t.Errorf("expected %v slips, got %v", workers*debits/2, n)
+	}
+}
+
+func TestDebitEvictBehindIndebted(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.window = second
+	rrl.tableShards = 1
+	rrl.maxTableSize = 4
+	rrl.initTable()
+
+	// an account pushed deep into debt that has gone quiet, and recovered accounts used after it
+	now := time.Now().UnixNano()
+	rrl.table.Add(testToken("indebted"), &ResponseAccount{allowTime: now + second})
+	for i := 0; i < 3; i++ {
+		rrl.table.Add(testToken("recovered"+strconv.Itoa(i)), &ResponseAccount{allowTime: now - 2*second})
+	}
+
+	// a new account evicts a recovered account, rather than failing behind the indebted one
+	if _, _, err := rrl.debit(&rrl.policy, second/10, testToken("new")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, found := rrl.table.Get(testToken("indebted")); !found {
+		t.Error("expected the indebted account to remain")
+	}
+	if _, found := rrl.table.Get(testToken("recovered0")); found {
+		t.Error("expected the least recently used recovered account to be evicted")
+	}
+}
+
+func TestDebitSustained(t *testing.T) {
+	// 20 responses per second, and with a sustained limit, 5 per second averaged over 60 seconds
+	perSecond := &policy{window: 15 * second, responsesInterval: second / 20}
+	sustained := &policy{window: 15 * second, responsesInterval: second / 20}
+	sustained.sustained = map[uint8]sustainedLimit{rTypeResponse: {interval: second / 5, period: 60 * second}}
+	start := int64(1000 * second)
+
+	tests := []struct {
+		rate      int64 // responses per second after the spike
+		sustained bool
+		allowed   [2]int // responses allowed in the first 50 seconds, and in the last 30 seconds of 120
+	}{
+		// a brief spike is allowed, but a steady stream over the sustained rate is limited once the bucket is empty
+		{rate: 10, sustained: true, allowed: [2]int{500, 0}},
+		// the per-second allowance alone can't tell the steady stream from legitimate traffic
+		{rate: 10, sustained: false, allowed: [2]int{500, 300}},
+		// a stream under the sustained rate is never limited
+		{rate: 4, sustained: true, allowed: [2]int{200, 120}},
+	}
+
+	for i, test := range tests {
+		p := perSecond
+		ra := &ResponseAccount{allowTime: start - second}
+		if test.sustained {
+			p = sustained
+			ra.sustainedAllowTime = start - 60*second
+		}
+
+		// a spike of 20 responses at once uses up the per-second allowance
+		for j := 1; j <= 20; j++ {
+			if bal, _ := ra.debit(p, rTypeResponse, p.responsesInterval, second, start); bal < 0 {
+				t.Fatalf("Test %d: expected response %d of the spike to be allowed, got balance %v", i, j, bal)
+			}
+		}
+		if bal, _ := ra.debit(p, rTypeResponse, p.responsesInterval, second, start); bal >= 0 {
+			t.Errorf("Test %d: expected the response after the spike to be limited, got balance %v", i, bal)
+		}
+
+		var allowed [2]int
+		for now := start + second; now < start+121*second; now += second / test.rate {
+			bal, _ := ra.debit(p, rTypeResponse, p.responsesInterval, second, now)
+			if bal < 0 {
+				continue
+			}
+			if now < start+51*second {
+				allowed[0]++
+			} else if now >= start+91*second {
+				allowed[1]++
+			}
+		}
+		if allowed != test.allowed {
+			t.Errorf("Test %d: expected %v responses allowed, got %v", i, test.allowed, allowed)
+		}
+	}
+}
+
+func TestAmplified(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.window = second / 10
+	rrl.maxAmplification = 10
+	rrl.initTable()
+
+	// a 20x amplification factor is not limited until it has been sustained for the window
+	limited, _, err := rrl.amplified(testToken("token1"), 30, 600)
+	if err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	if limited {
+		t.Errorf("expected first response not to be limited")
+	}
+	limited, _, _ = rrl.amplified(testToken("token1"), 30, 600)
+	if limited {
+		t.Errorf("expected response within the window not to be limited")
+	}
+	time.Sleep(time.Duration(rrl.window / 2))
+	rrl.amplified(testToken("token1"), 30, 600)
+	time.Sleep(time.Duration(rrl.window / 2))
+	limited, _, _ = rrl.amplified(testToken("token1"), 30, 600)
+	if !limited {
+		t.Errorf("expected sustained amplification to be limited")
+	}
+
+	// small responses bring the factor back under the maximum, which lifts the limit
+	for i := 0; i < 100; i++ {
+		limited, _, _ = rrl.amplified(testToken("token1"), 30, 30)
+	}
+	if limited {
+		t.Errorf("expected response not to be limited once amplification dropped")
+	}
+
+	// an amplification factor under the maximum is never limited
+	rrl.amplified(testToken("token2"), 30, 300)
+	time.Sleep(time.Duration(rrl.window))
+	limited, _, _ = rrl.amplified(testToken("token2"), 30, 300)
+	if limited {
+		t.Errorf("expected amplification under the maximum not to be limited")
+	}
 }
 
 func TestResponseType(t *testing.T) {
@@ -116,92 +383,202 @@ func TestAllowanceForRtype(t *testing.T) {
 	}
 }
 
+func TestAllowanceForQtype(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.responsesInterval = 100
+	rrl.nodataInterval = 100
+	rrl.qtypeIntervals = map[uint16]int64{dns.TypeANY: 1000}
+
+	tests := []struct {
+		rtype    uint8
+		qtype    uint16
+		expected int64
+	}{
+		{rtype: rTypeResponse, qtype: dns.TypeA, expected: 100},
+		{rtype: rTypeResponse, qtype: dns.TypeANY, expected: 1000},
+		{rtype: rTypeNodata, qtype: dns.TypeANY, expected: 100},
+	}
+	for _, c := range tests {
+		got := rrl.allowanceForQtype(c.rtype, c.qtype)
+		if got != c.expected {
+			t.Errorf("expected '%v', got '%v'", c.expected, got)
+		}
+	}
+}
+
+func TestAllowanceForResponse(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.responsesInterval = 100
+	rrl.nxdomainsInterval = 100
+	rrl.bytesPerSecond = map[uint8]int64{rTypeResponse: 1000, rTypeNodata: 0}
+
+	tests := []struct {
+		rtype    uint8
+		size     int
+		expected int64
+	}{
+		{rtype: rTypeResponse, size: 100, expected: second / 10},
+		{rtype: rTypeResponse, size: 4000, expected: 4 * second},
+		{rtype: rTypeNodata, size: 100, expected: 0},
+		{rtype: rTypeNxdomain, size: 100, expected: 100},
+	}
+	for _, c := range tests {
+		got := rrl.allowanceForResponse(c.rtype, dns.TypeA, c.size)
+		if got != c.expected {
+			t.Errorf("expected '%v', got '%v'", c.expected, got)
+		}
+	}
+}
+
 func TestBuildToken(t *testing.T) {
+	name := strconv.FormatUint(hashName("example.com"), 16)
 	tests := []struct {
-		rtype      uint8
-		qtype      uint16
-		name       string
-		remoteAddr string
-		expected   string
+		rtype    uint8
+		qtype    uint16
+		name     string
+		ip       string
+		expected string
 	}{
 		{
-			rtype:      rTypeResponse,
-			qtype:      dns.TypeA,
-			name:       "example.com",
-			remoteAddr: "1.2.3.4:1234",
-			expected:   "1.2.3.0/0/1/example.com",
+			rtype:    rTypeResponse,
+			qtype:    dns.TypeA,
+			name:     "example.com",
+			ip:       "1.2.3.4",
+			expected: "1.2.3.0/0/1/" + name,
+		},
+		{
+			rtype:    rTypeNodata,
+			qtype:    dns.TypeA,
+			name:     "example.com",
+			ip:       "1.2.3.4",
+			expected: "1.2.3.0/1//" + name,
+		},
+		{
+			rtype:    rTypeError,
+			qtype:    dns.TypeA,
+			name:     "example.com",
+			ip:       "1.2.3.4",
+			expected: "1.2.3.0/4//",
 		},
 		{
-			rtype:      rTypeNodata,
-			qtype:      dns.TypeA,
-			name:       "example.com",
-			remoteAddr: "1.2.3.4:1234",
-			expected:   "1.2.3.0/1//example.com",
+			rtype:    rTypeNxdomain,
+			qtype:    dns.TypeA,
+			name:     "example.com",
+			ip:       "1.2.3.4",
+			expected: "1.2.3.0/2//" + name,
 		},
 		{
-			rtype:      rTypeError,
-			qtype:      dns.TypeA,
-			name:       "example.com",
-			remoteAddr: "1.2.3.4:1234",
-			expected:   "1.2.3.0/4//",
+			rtype:    rTypeReferral,
+			qtype:    dns.TypeA,
+			name:     "example.com",
+			ip:       "1.2.3.4",
+			expected: "1.2.3.0/3/1/" + name,
 		},
 		{
-			rtype:      rTypeNxdomain,
-			qtype:      dns.TypeA,
-			name:       "example.com",
-			remoteAddr: "1.2.3.4:1234",
-			expected:   "1.2.3.0/2//example.com",
+			rtype:    rTypeAll,
+			qtype:    dns.TypeA,
+			name:     "example.com",
+			ip:       "1.2.3.4",
+			expected: "1.2.3.0/5//",
 		},
 		{
-			rtype:      rTypeReferral,
-			qtype:      dns.TypeA,
-			name:       "example.com",
-			remoteAddr: "1.2.3.4:1234",
-			expected:   "1.2.3.0/3/1/example.com",
+			rtype:    rTypeAmplification,
+			qtype:    dns.TypeA,
+			name:     "example.com",
+			ip:       "1.2.3.4",
+			expected: "1.2.3.0/6//",
+		},
+		{
+			rtype:    rTypeRequest,
+			qtype:    dns.TypeA,
+			name:     "example.com",
+			ip:       "1.2.3.4",
+			expected: "1.2.3.0/7//",
+		},
+		{
+			rtype:    rTypeResponse,
+			qtype:    dns.TypeAAAA,
+			name:     "EXAMPLE.com",
+			ip:       "2001:db8::1",
+			expected: "2001:db8::/0/28/" + name,
 		},
 	}
 	rrl := defaultRRL()
 	for _, c := range tests {
-		got := rrl.buildToken(c.rtype, c.qtype, c.name, c.remoteAddr)
+		token := rrl.buildToken(c.rtype, c.qtype, c.name, net.ParseIP(c.ip))
+		got := tokenString(token)
 		if got != c.expected {
 			t.Errorf("expected '%v', got '%v'", c.expected, got)
 		}
+		parsed, err := parseTokenString(got)
+		if err != nil {
+			t.Errorf("expected no error parsing '%v', got %v", got, err)
+		}
+		if parsed != token {
+			t.Errorf("expected '%v' to parse to %+v, got %+v", got, token, parsed)
+		}
+	}
+
+	for _, s := range []string{"1.2.3.0", "banana/0//", "1.2.3.0/x//", "1.2.3.0/0/x/", "1.2.3.0/0//xyz"} {
+		if _, err := parseTokenString(s); err == nil {
+			t.Errorf("expected error parsing '%v'", s)
+		}
 	}
 }
 
-func TestAddrPrefix(t *testing.T) {
+func TestMatchZone(t *testing.T) {
+	zones := []string{"example.org.", "sub.example.org.", "example.net."}
+	for _, qname := range []string{
+		"example.org.", "www.example.org.", "sub.example.org.", "www.sub.example.org.", "xsub.example.org.",
+		"example.net.", "www.example.net.", "xexample.net.", "example.com.", "org.", ".",
+	} {
+		if got, expected := matchZone(zones, qname), plugin.Zones(zones).Matches(qname); got != expected {
+			t.Errorf("expected '%v' to match '%v', got '%v'", qname, expected, got)
+		}
+	}
+	if got := matchZone([]string{"."}, "www.example.org."); got != "." {
+		t.Errorf("expected root zone to match, got '%v'", got)
+	}
+}
+
+func TestPrefix(t *testing.T) {
 	tests := []struct {
 		ipv4Prefix, ipv6Prefix int
-		remoteAddr, expected   string
+		ip, expected           string
 	}{
 		{
 			ipv4Prefix: 24,
-			remoteAddr: "1.2.3.4:1234",
+			ip:         "1.2.3.4",
 			expected:   "1.2.3.0",
 		},
 		{
 			ipv6Prefix: 56,
-			remoteAddr: "[1234:5678::1]:80",
+			ip:         "1234:5678::1",
 			expected:   "1234:5678::",
 		},
 		{
 			ipv4Prefix: 8,
-			remoteAddr: "1.2.3.4:1234",
+			ip:         "1.2.3.4",
 			expected:   "1.0.0.0",
 		},
+		{
+			ipv4Prefix: 20,
+			ip:         "1.2.255.4",
+			expected:   "1.2.240.0",
+		},
 		{
 			ipv6Prefix: 16,
-			remoteAddr: "[1234:5678::1]:80",
+			ip:         "1234:5678::1",
 			expected:   "1234::",
 		},
 		{
 			ipv4Prefix: 32,
-			remoteAddr: "1.2.3.4:1234",
+			ip:         "1.2.3.4",
 			expected:   "1.2.3.4",
 		},
 		{
 			ipv6Prefix: 128,
-			remoteAddr: "[1234:5678::1]:80",
+			ip:         "1234:5678::1",
 			expected:   "1234:5678::1",
 		},
 	}
@@ -210,7 +587,7 @@ func TestAddrPrefix(t *testing.T) {
 	for _, c := range tests {
 		rrl.ipv4PrefixLength = c.ipv4Prefix
 		rrl.ipv6PrefixLength = c.ipv6Prefix
-		got := rrl.addrPrefix(c.remoteAddr)
+		got := prefixString(rrl.prefix(net.ParseIP(c.ip)))
 		if got != c.expected {
 			t.Errorf("expected '%v', got '%v'", c.expected, got)
 		}
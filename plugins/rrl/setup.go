@@ -1,12 +1,22 @@
 package rrl
 
 import (
+	"fmt"
+	"math"
+	"net"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/rrl/plugins/rrl/cache"
+	"github.com/coredns/rrl/plugins/rrl/cidr"
+
+	"github.com/miekg/dns"
 )
 
 var log = clog.NewWithPlugin("rrl")
@@ -24,6 +34,66 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("rrl", err)
 	}
 
+	if (e.exemptFile != nil || e.blockFile != nil) && e.listReload > 0 {
+		stop := make(chan struct{})
+		c.OnStartup(func() error {
+			go e.reloadLists(stop)
+			return nil
+		})
+		c.OnShutdown(func() error {
+			close(stop)
+			return nil
+		})
+	}
+
+	if e.sweepInterval > 0 {
+		stop := make(chan struct{})
+		c.OnStartup(func() error {
+			go e.janitor(stop)
+			return nil
+		})
+		c.OnShutdown(func() error {
+			close(stop)
+			return nil
+		})
+	}
+
+	if e.stateFile != "" {
+		c.OnStartup(func() error {
+			if err := e.loadState(); err != nil {
+				log.Warningf("failed to restore state from %v: %v", e.stateFile, err)
+			}
+			return nil
+		})
+		// Save on restart rather than on shutdown, because when reloading, the new instance starts up before
+		// the old instance shuts down.
+		save := func() error {
+			if err := e.saveState(); err != nil {
+				log.Warningf("failed to save state to %v: %v", e.stateFile, err)
+			}
+			return nil
+		}
+		c.OnRestart(save)
+		c.OnFinalShutdown(save)
+	}
+
+	if s, ok := e.table.(StoreService); ok {
+		// Stop on restart rather than on shutdown, to free resources such as addresses for the new instance.
+		c.OnStartup(s.Start)
+		c.OnRestart(s.Stop)
+		c.OnRestartFailed(s.Start)
+		c.OnFinalShutdown(s.Stop)
+	}
+
+	if e.adminAddr != "" {
+		a := &admin{addr: e.adminAddr, rrl: e}
+		// Stop on restart rather than on shutdown, to free the address for the new instance.
+		c.OnStartup(a.start)
+		c.OnRestart(a.stop)
+		c.OnRestartFailed(a.start)
+		c.OnFinalShutdown(a.stop)
+	}
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		e.Next = next
 		return e
@@ -34,42 +104,35 @@ func setup(c *caddy.Controller) error {
 
 func defaultRRL() RRL {
 	return RRL{
-		window:           15 * second,
+		policy: policy{
+			window: 15 * second,
+		},
 		ipv4PrefixLength: 24,
 		ipv6PrefixLength: 56,
 		maxTableSize:     100000,
+		tableShards:      cache.DefaultShards,
+		listReload:       5 * time.Second,
+		sweepInterval:    30 * time.Second,
 	}
 }
 
+// policyOption applies a parsed policy directive to a policy
+type policyOption func(p *policy)
+
 func rrlParse(c *caddy.Controller) (*RRL, error) {
 	rrl := defaultRRL()
 
-	var (
-		nodataIntervalSet    bool
-		nxdomainsIntervalSet bool
-		referralsIntervalSet bool
-		errorsIntervalSet    bool
-	)
-
 	for c.Next() {
 		rrl.Zones = plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), c.ServerBlockKeys)
 
+		var (
+			opts     []policyOption
+			zoneOpts = make(map[string][]policyOption)
+		)
+
 		if c.NextBlock() {
 			for {
 				switch c.Val() {
-				case "window":
-					args := c.RemainingArgs()
-					if len(args) != 1 {
-						return nil, c.ArgErr()
-					}
-					w, err := strconv.ParseFloat(args[0], 64)
-					if err != nil {
-						return nil, c.Errf("%v invalid value. %v", c.Val(), err)
-					}
-					if w <= 0 {
-						return nil, c.Err("window must be greater than zero")
-					}
-					rrl.window = int64(w * second)
 				case "ipv4-prefix-length":
 					args := c.RemainingArgs()
 					if len(args) != 1 {
@@ -96,59 +159,47 @@ func rrlParse(c *caddy.Controller) (*RRL, error) {
 						return nil, c.Errf("%v must be between 1 and 128", c.Val())
 					}
 					rrl.ipv6PrefixLength = i
-				case "responses-per-second":
+				case "all-per-second":
 					i, err := getIntervalArg(c)
 					if err != nil {
 						return nil, err
 					}
-					rrl.responsesInterval = i
-				case "nodata-per-second":
-					i, err := getIntervalArg(c)
-					if err != nil {
-						return nil, err
+					rrl.allInterval = i
+				case "max-amplification":
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
 					}
-					rrl.nodataInterval = i
-					nodataIntervalSet = true
-				case "nxdomains-per-second":
-					i, err := getIntervalArg(c)
+					f, err := strconv.ParseFloat(args[0], 64)
 					if err != nil {
-						return nil, err
+						return nil, c.Errf("%v invalid value. %v", c.Val(), err)
 					}
-					rrl.nxdomainsInterval = i
-					nxdomainsIntervalSet = true
-				case "referrals-per-second":
-					i, err := getIntervalArg(c)
-					if err != nil {
-						return nil, err
+					if math.IsNaN(f) || math.IsInf(f, 0) {
+						return nil, c.Errf("%v must be a finite number", c.Val())
 					}
-					rrl.referralsInterval = i
-					referralsIntervalSet = true
-				case "errors-per-second":
+					if f < 0 {
+						return nil, c.Errf("%v cannot be negative", c.Val())
+					}
+					rrl.maxAmplification = f
+				case "requests-per-second":
 					i, err := getIntervalArg(c)
 					if err != nil {
 						return nil, err
 					}
-					rrl.errorsInterval = i
-					errorsIntervalSet = true
-				case "slip-ratio":
+					rrl.requestsInterval = i
+				case "qps-scale":
 					args := c.RemainingArgs()
 					if len(args) != 1 {
 						return nil, c.ArgErr()
 					}
-					i, err := strconv.Atoi(c.Val())
+					i, err := strconv.ParseInt(args[0], 10, 64)
 					if err != nil {
-						return nil, c.Errf("slip-ratio '%v' invalid value. %v", c.Val(), err)
-					}
-					if i < 0 || i > 10 {
-						return nil, c.Errf("slip-ratio '%v' must be between 0 and 10", c.Val())
+						return nil, c.Errf("%v invalid value. %v", c.Val(), err)
 					}
-					rrl.slipRatio = uint(i)
-				case "requests-per-second":
-					i, err := getIntervalArg(c)
-					if err != nil {
-						return nil, err
+					if i < 0 {
+						return nil, c.Errf("%v cannot be negative", c.Val())
 					}
-					rrl.requestsInterval = i
+					rrl.qpsScale = i
 				case "max-table-size":
 					args := c.RemainingArgs()
 					if len(args) != 1 {
@@ -168,10 +219,208 @@ func rrlParse(c *caddy.Controller) (*RRL, error) {
 						return nil, c.ArgErr()
 					}
 					rrl.reportOnly = true
+				case "exempt-clients":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					if rrl.exemptClients == nil {
+						rrl.exemptClients = cidr.New()
+					}
+					for _, a := range args {
+						n, err := cidr.Parse(a)
+						if err != nil {
+							return nil, c.Errf("exempt-clients '%v' invalid value. %v", a, err)
+						}
+						rrl.exemptClients.Insert(n)
+					}
+				case "exempt-file", "block-file":
+					name := c.Val()
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					path := args[0]
+					if root := dnsserver.GetConfig(c).Root; !filepath.IsAbs(path) && root != "" {
+						path = filepath.Join(root, path)
+					}
+					f, err := newCIDRFile(path)
+					if err != nil {
+						return nil, c.Errf("%v '%v' could not be loaded. %v", name, path, err)
+					}
+					if name == "exempt-file" {
+						if rrl.exemptFile != nil {
+							return nil, c.Errf("%v can only be set once", name)
+						}
+						rrl.exemptFile = f
+					} else {
+						if rrl.blockFile != nil {
+							return nil, c.Errf("%v can only be set once", name)
+						}
+						rrl.blockFile = f
+					}
+				case "state-file":
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					path := args[0]
+					if root := dnsserver.GetConfig(c).Root; !filepath.IsAbs(path) && root != "" {
+						path = filepath.Join(root, path)
+					}
+					rrl.stateFile = path
+				case "admin":
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					if _, _, err := net.SplitHostPort(args[0]); err != nil {
+						return nil, c.Errf("%v invalid address. %v", c.Val(), err)
+					}
+					rrl.adminAddr = args[0]
+				case "store":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					t, ok := lookupStore(c.Val())
+					if !ok {
+						return nil, c.Errf("unknown store type '%v'", c.Val())
+					}
+					newStore, err := t(c)
+					if err != nil {
+						return nil, err
+					}
+					rrl.newStore = newStore
+				case "log-drops":
+					name := c.Val()
+					if rrl.dropLog != nil {
+						return nil, c.Errf("%v can only be set once", name)
+					}
+					dl := &dropLogger{sample: 1}
+					args := c.RemainingArgs()
+					for i := 0; i < len(args); i++ {
+						switch args[i] {
+						case "json":
+							dl.json = true
+						case "text":
+							dl.json = false
+						case "sample":
+							if i+1 >= len(args) {
+								return nil, c.ArgErr()
+							}
+							i++
+							n, err := strconv.ParseUint(args[i], 10, 64)
+							if err != nil || n == 0 {
+								return nil, c.Errf("%v invalid sample '%v', must be a positive integer", name, args[i])
+							}
+							dl.sample = n
+						default:
+							return nil, c.Errf("%v unknown argument '%v'", name, args[i])
+						}
+					}
+					rrl.dropLog = dl
+				case "metrics-labels":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					switch args[0] {
+					case "ip", "prefix":
+						if len(args) != 1 {
+							return nil, c.ArgErr()
+						}
+						rrl.metricsLabels = labelIP
+						if args[0] == "prefix" {
+							rrl.metricsLabels = labelPrefix
+						}
+					case "top":
+						if len(args) != 2 {
+							return nil, c.ArgErr()
+						}
+						k, err := strconv.Atoi(args[1])
+						if err != nil || k <= 0 {
+							return nil, c.Errf("metrics-labels invalid top '%v', must be a positive integer", args[1])
+						}
+						rrl.metricsLabels = labelTop
+						rrl.topClients = newTopK(k)
+					default:
+						return nil, c.Errf("metrics-labels unknown label set '%v'", args[0])
+					}
+				case "table-shards":
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					i, err := strconv.Atoi(args[0])
+					if err != nil {
+						return nil, c.Errf("%v invalid value. %v", c.Val(), err)
+					}
+					if i <= 0 || i&(i-1) != 0 {
+						return nil, c.Errf("%v must be a power of two", c.Val())
+					}
+					rrl.tableShards = i
+				case "table-mode":
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					mode, ok := tableModes[args[0]]
+					if !ok {
+						return nil, c.Errf("%v unknown mode '%v'", c.Val(), args[0])
+					}
+					rrl.tableMode = mode
+				case "sweep-interval":
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					d, err := time.ParseDuration(args[0])
+					if err != nil {
+						return nil, c.Errf("%v invalid value. %v", c.Val(), err)
+					}
+					if d < 0 {
+						return nil, c.Errf("%v cannot be negative", c.Val())
+					}
+					rrl.sweepInterval = d
+				case "list-reload":
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					d, err := time.ParseDuration(args[0])
+					if err != nil {
+						return nil, c.Errf("%v invalid value. %v", c.Val(), err)
+					}
+					if d < 0 {
+						return nil, c.Errf("%v cannot be negative", c.Val())
+					}
+					rrl.listReload = d
+				case "zone":
+					zones, o, err := parseZoneBlock(c)
+					if err != nil {
+						return nil, err
+					}
+					for _, z := range zones {
+						if plugin.Zones(rrl.Zones).Matches(z) == "" {
+							return nil, c.Errf("zone '%v' is not within the zones of this rrl block", z)
+						}
+						if _, ok := zoneOpts[z]; ok {
+							return nil, c.Errf("zone '%v' is defined more than once", z)
+						}
+						zoneOpts[z] = o
+						rrl.policyZones = append(rrl.policyZones, z)
+					}
+				case "}":
+					// end of the rrl block
 				default:
-					if c.Val() != "}" {
+					o, err := parsePolicyOption(c)
+					if err != nil {
+						return nil, err
+					}
+					if o == nil {
 						return nil, c.Errf("unknown property '%s'", c.Val())
 					}
+					opts = append(opts, o)
 				}
 
 				if !c.Next() {
@@ -180,34 +429,328 @@ func rrlParse(c *caddy.Controller) (*RRL, error) {
 			}
 		}
 
-		// If any allowance intervals were not set, default them to responsesInterval
-		if !nodataIntervalSet {
-			rrl.nodataInterval = rrl.responsesInterval
-		}
-		if !nxdomainsIntervalSet {
-			rrl.nxdomainsInterval = rrl.responsesInterval
+		rrl.policy = buildPolicy(opts)
+		if err := rrl.policy.checkBursts(); err != nil {
+			return nil, c.Err(err.Error())
 		}
-		if !referralsIntervalSet {
-			rrl.referralsInterval = rrl.responsesInterval
-		}
-		if !errorsIntervalSet {
-			rrl.errorsInterval = rrl.responsesInterval
+		if len(zoneOpts) > 0 {
+			// zone blocks inherit the top level options, and override them
+			rrl.zonePolicies = make(map[string]*policy, len(zoneOpts))
+			for z, o := range zoneOpts {
+				p := buildPolicy(append(append([]policyOption{}, opts...), o...))
+				if err := p.checkBursts(); err != nil {
+					return nil, c.Errf("zone '%v': %v", z, err)
+				}
+				rrl.zonePolicies[z] = &p
+			}
 		}
 
 		// initialize table
-		rrl.initTable()
+		if err := rrl.initTable(); err != nil {
+			return nil, c.Errf("failed to create store: %v", err)
+		}
+		if rrl.sketch != nil && rrl.debits != nil {
+			return nil, c.Err("table-mode sketch can not be used with a store that shares debits")
+		}
 
 		return &rrl, nil
 	}
 	return nil, nil
 }
 
+// buildPolicy returns the default policy with opts applied in order.
+// Any allowance intervals that were not set default to the responses interval.
+func buildPolicy(opts []policyOption) policy {
+	p := defaultRRL().policy
+	p.nodataInterval = -1
+	p.nxdomainsInterval = -1
+	p.referralsInterval = -1
+	p.errorsInterval = -1
+
+	for _, o := range opts {
+		o(&p)
+	}
+
+	if p.nodataInterval < 0 {
+		p.nodataInterval = p.responsesInterval
+	}
+	if p.nxdomainsInterval < 0 {
+		p.nxdomainsInterval = p.responsesInterval
+	}
+	if p.referralsInterval < 0 {
+		p.referralsInterval = p.responsesInterval
+	}
+	if p.errorsInterval < 0 {
+		p.errorsInterval = p.responsesInterval
+	}
+	return p
+}
+
+// checkBursts returns an error if the credit of a burst of p does not fit in an int64, e.g. a large burst at a very
+// low per-second allowance, since a wrapped credit would keep accounts from ever expiring.
+func (p *policy) checkBursts() error {
+	for rtype, n := range p.bursts {
+		if _, ok := p.bytesPerSecond[rtype]; ok {
+			// the credit is n * second / bps, which fits for any burst up to maxBurst
+			continue
+		}
+		allowances := []int64{p.allowanceForRtype(rtype)}
+		if rtype == rTypeResponse {
+			for _, i := range p.qtypeIntervals {
+				allowances = append(allowances, i)
+			}
+		}
+		for _, a := range allowances {
+			if a > math.MaxInt64/n {
+				for name, t := range rtypeNames {
+					if t == rtype {
+						return fmt.Errorf("burst %v %d is too large for the per-second allowance of %v", name, n, name)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// parseZoneBlock parses a zone block, returning the zones it applies to and its policy options. Each option is on a
+// line of its own, and the closing brace on the line after the last one, e.g.
+//
+//	zone example.org {
+//	    responses-per-second 5
+//	}
+func parseZoneBlock(c *caddy.Controller) ([]string, []policyOption, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, nil, c.ArgErr()
+	}
+	var zones []string
+	for _, a := range args {
+		zones = append(zones, plugin.Host(a).NormalizeExact()...)
+	}
+	if !c.Next() || c.Val() != "{" {
+		return nil, nil, c.Err("zone requires a block")
+	}
+
+	var opts []policyOption
+	for c.Next() {
+		if c.Val() == "}" {
+			return zones, opts, nil
+		}
+		o, err := parsePolicyOption(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		if o == nil {
+			return nil, nil, c.Errf("unknown zone property '%s'", c.Val())
+		}
+		opts = append(opts, o)
+	}
+	return nil, nil, c.EOFErr()
+}
+
+// parsePolicyOption parses the current directive if it is one that can be set per zone.
+// It returns a nil option if the directive is not a policy option.
+func parsePolicyOption(c *caddy.Controller) (policyOption, error) {
+	switch c.Val() {
+	case "window":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return nil, c.ArgErr()
+		}
+		w, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return nil, c.Errf("%v invalid value. %v", c.Val(), err)
+		}
+		if w <= 0 {
+			return nil, c.Err("window must be greater than zero")
+		}
+		return func(p *policy) { p.window = int64(w * second) }, nil
+	case "responses-per-second":
+		i, err := getIntervalArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return func(p *policy) { p.responsesInterval = i }, nil
+	case "nodata-per-second":
+		i, err := getIntervalArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return func(p *policy) { p.nodataInterval = i }, nil
+	case "nxdomains-per-second":
+		i, err := getIntervalArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return func(p *policy) { p.nxdomainsInterval = i }, nil
+	case "referrals-per-second":
+		i, err := getIntervalArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return func(p *policy) { p.referralsInterval = i }, nil
+	case "errors-per-second":
+		i, err := getIntervalArg(c)
+		if err != nil {
+			return nil, err
+		}
+		return func(p *policy) { p.errorsInterval = i }, nil
+	case "qtype-per-second":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(args[0])]
+		if !ok {
+			return nil, c.Errf("%v invalid qtype '%v'", c.Val(), args[0])
+		}
+		i, err := parseInterval(c, args[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(p *policy) {
+			if p.qtypeIntervals == nil {
+				p.qtypeIntervals = make(map[uint16]int64)
+			}
+			p.qtypeIntervals[qtype] = i
+		}, nil
+	case "bytes-per-second":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		rtype, ok := rtypeNames[args[0]]
+		if !ok {
+			return nil, c.Errf("%v invalid response type '%v'", c.Val(), args[0])
+		}
+		bps, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, c.Errf("%v invalid value. %v", c.Val(), err)
+		}
+		if bps < 0 {
+			return nil, c.Errf("%v cannot be negative", c.Val())
+		}
+		return func(p *policy) {
+			if p.bytesPerSecond == nil {
+				p.bytesPerSecond = make(map[uint8]int64)
+			}
+			p.bytesPerSecond[rtype] = bps
+		}, nil
+	case "burst":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		rtype, ok := rtypeNames[args[0]]
+		if !ok {
+			return nil, c.Errf("%v invalid response type '%v'", c.Val(), args[0])
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, c.Errf("%v invalid value. %v", c.Val(), err)
+		}
+		if n < 1 || n > maxBurst {
+			return nil, c.Errf("%v must be between 1 and %d", c.Val(), maxBurst)
+		}
+		return func(p *policy) {
+			if p.bursts == nil {
+				p.bursts = make(map[uint8]int64)
+			}
+			p.bursts[rtype] = n
+		}, nil
+	case "sustained-per-second":
+		args := c.RemainingArgs()
+		if len(args) != 3 {
+			return nil, c.ArgErr()
+		}
+		rtype, ok := rtypeNames[args[0]]
+		if !ok {
+			return nil, c.Errf("%v invalid response type '%v'", c.Val(), args[0])
+		}
+		i, err := parseInterval(c, args[1])
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			return nil, c.Errf("%v must be positive", c.Val())
+		}
+		d, err := time.ParseDuration(args[2])
+		if err != nil {
+			return nil, c.Errf("%v invalid period. %v", c.Val(), err)
+		}
+		if d < time.Second {
+			return nil, c.Errf("%v period must be at least 1s", c.Val())
+		}
+		if i > int64(d) {
+			return nil, c.Errf("%v period must allow at least one response", c.Val())
+		}
+		return func(p *policy) {
+			if p.sustained == nil {
+				p.sustained = make(map[uint8]sustainedLimit)
+			}
+			p.sustained[rtype] = sustainedLimit{interval: i, period: int64(d)}
+		}, nil
+	case "slip-ratio":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return nil, c.ArgErr()
+		}
+		i, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return nil, c.Errf("slip-ratio '%v' invalid value. %v", c.Val(), err)
+		}
+		if i < 0 || i > 10 {
+			return nil, c.Errf("slip-ratio '%v' must be between 0 and 10", c.Val())
+		}
+		return func(p *policy) { p.slipRatio = uint32(i) }, nil
+	case "on-table-full":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return nil, c.ArgErr()
+		}
+		action, ok := tableFullActions[args[0]]
+		if !ok {
+			return nil, c.Errf("%v invalid action '%v', must be one of allow, drop or slip", c.Val(), args[0])
+		}
+		return func(p *policy) { p.onTableFull = action }, nil
+	}
+	return nil, nil
+}
+
+// tableFullActions maps the on-table-full action names to actions
+var tableFullActions = map[string]uint8{
+	"allow": tableFullAllow,
+	"drop":  tableFullDrop,
+	"slip":  tableFullSlip,
+}
+
+// tableModes maps the modes of table-mode to table modes
+var tableModes = map[string]uint8{
+	"exact":  tableModeExact,
+	"sketch": tableModeSketch,
+}
+
+// rtypeNames maps the response type names used in options to response types
+var rtypeNames = map[string]uint8{
+	"responses": rTypeResponse,
+	"nodata":    rTypeNodata,
+	"nxdomains": rTypeNxdomain,
+	"referrals": rTypeReferral,
+	"errors":    rTypeError,
+}
+
 func getIntervalArg(c *caddy.Controller) (int64, error) {
 	args := c.RemainingArgs()
 	if len(args) != 1 {
 		return 0, c.ArgErr()
 	}
-	rps, err := strconv.ParseFloat(args[0], 64)
+	return parseInterval(c, args[0])
+}
+
+// parseInterval converts a per-second allowance to the interval between allowed responses
+func parseInterval(c *caddy.Controller, arg string) (int64, error) {
+	rps, err := strconv.ParseFloat(arg, 64)
 	if err != nil {
 		return 0, c.Errf("%v invalid value. %v", c.Val(), err)
 	}
@@ -222,3 +765,7 @@ func getIntervalArg(c *caddy.Controller) (int64, error) {
 }
 
 const second = 1000000000
+
+// maxBurst is the largest burst. The credit of a burst at a per-second allowance may still overflow, which
+// checkBursts rejects.
+const maxBurst = 1000000
@@ -2,9 +2,16 @@ package rrl
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/rrl/plugins/rrl/cache"
+	"github.com/miekg/dns"
 )
 
 func TestSetupZones(t *testing.T) {
@@ -71,11 +78,13 @@ func TestSetupAllowances(t *testing.T) {
                  }`,
 			shouldErr: false,
 			expected: RRL{
-				responsesInterval: second / 10,
-				nodataInterval:    second / 10,
-				nxdomainsInterval: second / 10,
-				referralsInterval: second / 10,
-				errorsInterval:    second / 10,
+				policy: policy{
+					responsesInterval: second / 10,
+					nodataInterval:    second / 10,
+					nxdomainsInterval: second / 10,
+					referralsInterval: second / 10,
+					errorsInterval:    second / 10,
+				},
 			},
 		},
 		{input: `rrl {
@@ -87,13 +96,43 @@ func TestSetupAllowances(t *testing.T) {
                  }`,
 			shouldErr: false,
 			expected: RRL{
-				responsesInterval: second / 10,
-				nodataInterval:    second / 5,
-				nxdomainsInterval: second / 6,
-				referralsInterval: second / 7,
-				errorsInterval:    second / 8,
+				policy: policy{
+					responsesInterval: second / 10,
+					nodataInterval:    second / 5,
+					nxdomainsInterval: second / 6,
+					referralsInterval: second / 7,
+					errorsInterval:    second / 8,
+				},
 			},
 		},
+		{input: `rrl {
+                   responses-per-second 10
+                   all-per-second 20
+                 }`,
+			shouldErr: false,
+			expected: RRL{
+				policy: policy{
+					responsesInterval: second / 10,
+					nodataInterval:    second / 10,
+					nxdomainsInterval: second / 10,
+					referralsInterval: second / 10,
+					errorsInterval:    second / 10,
+				},
+				allInterval: second / 20,
+			},
+		},
+		{input: `rrl {
+                   all-per-second 10 11
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   all-per-second -1
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
 		{input: `rrl {
                    responses-per-second 10 11
                  }`,
@@ -216,6 +255,9 @@ func TestSetupAllowances(t *testing.T) {
 		if rrl.errorsInterval != test.expected.errorsInterval {
 			t.Errorf("Test %v: Expected errorsInterval %v but found: %v", i, test.expected.errorsInterval, rrl.errorsInterval)
 		}
+		if rrl.allInterval != test.expected.allInterval {
+			t.Errorf("Test %v: Expected allInterval %v but found: %v", i, test.expected.allInterval, rrl.allInterval)
+		}
 	}
 }
 
@@ -234,7 +276,7 @@ func TestSetupWindow(t *testing.T) {
                  }`,
 			shouldErr: false,
 			expected: RRL{
-				window: 10 * second,
+				policy: policy{window: 10 * second},
 			},
 		},
 		{input: `rrl {
@@ -429,6 +471,150 @@ func TestSetupTableSize(t *testing.T) {
 	}
 }
 
+func TestSetupQPSScale(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  RRL
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+			expected:  defaultRRL(),
+		},
+		{input: `rrl {
+                   qps-scale 250
+                 }`,
+			shouldErr: false,
+			expected:  RRL{qpsScale: 250},
+		},
+		{input: `rrl {
+                   qps-scale -1
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   qps-scale 2.5
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   qps-scale 1 2
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if rrl.qpsScale != test.expected.qpsScale {
+			t.Errorf("Test %v: Expected qpsScale %v but found: %v", i, test.expected.qpsScale, rrl.qpsScale)
+		}
+	}
+}
+
+func TestSetupMaxAmplification(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  RRL
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+			expected:  defaultRRL(),
+		},
+		{input: `rrl {
+                   max-amplification 12.5
+                 }`,
+			shouldErr: false,
+			expected:  RRL{maxAmplification: 12.5},
+		},
+		{input: `rrl {
+                   max-amplification -1
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   max-amplification lots
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   max-amplification NaN
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   max-amplification Inf
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   max-amplification +Inf
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   max-amplification -Inf
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   max-amplification infinity
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+		{input: `rrl {
+                   max-amplification 1 2
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if rrl.maxAmplification != test.expected.maxAmplification {
+			t.Errorf("Test %v: Expected maxAmplification %v but found: %v", i, test.expected.maxAmplification, rrl.maxAmplification)
+		}
+	}
+}
+
 func TestSetupSlipRatio(t *testing.T) {
 	tests := []struct {
 		input     string
@@ -443,7 +629,7 @@ func TestSetupSlipRatio(t *testing.T) {
                    slip-ratio 5
                  }`,
 			shouldErr: false,
-			expected:  RRL{slipRatio: 5},
+			expected:  RRL{policy: policy{slipRatio: 5}},
 		},
 		{input: `rrl {
                    slip-ratio -1
@@ -492,23 +678,187 @@ func TestSetupSlipRatio(t *testing.T) {
 	}
 }
 
-func TestSetupInvalidOption(t *testing.T) {
+func TestSetupExemptClients(t *testing.T) {
 	tests := []struct {
 		input     string
 		shouldErr bool
-		expected  RRL
+		exempt    []string
+		notExempt []string
 	}{
+		{input: `rrl`,
+			shouldErr: false,
+			notExempt: []string{"10.0.0.1", "2001:db8::1"},
+		},
 		{input: `rrl {
-                   blah
+                   exempt-clients 10.0.0.0/8 192.168.1.1
+                   exempt-clients 2001:db8::/32
+                 }`,
+			shouldErr: false,
+			exempt:    []string{"10.0.0.1", "10.255.0.1", "192.168.1.1", "2001:db8::1"},
+			notExempt: []string{"11.0.0.1", "192.168.1.2", "2001:db9::1"},
+		},
+		{input: `rrl {
+                   exempt-clients
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   exempt-clients 10.0.0.0/33
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   exempt-clients localhost
                  }`,
 			shouldErr: true,
-			expected:  RRL{},
 		},
 	}
 
 	for i, test := range tests {
 		c := caddy.NewTestController("dns", test.input)
-		_, err := rrlParse(c)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		for _, ip := range test.exempt {
+			if !rrl.exempt(net.ParseIP(ip)) {
+				t.Errorf("Test %v: Expected %v to be exempt", i, ip)
+			}
+		}
+		for _, ip := range test.notExempt {
+			if rrl.exempt(net.ParseIP(ip)) {
+				t.Errorf("Test %v: Expected %v not to be exempt", i, ip)
+			}
+		}
+	}
+}
+
+func TestSetupListFiles(t *testing.T) {
+	dir := t.TempDir()
+	exemptPath := filepath.Join(dir, "exempt.txt")
+	blockPath := filepath.Join(dir, "block.txt")
+	os.WriteFile(exemptPath, []byte("10.0.0.0/8\n"), 0644)
+	os.WriteFile(blockPath, []byte("192.0.2.0/24\n"), 0644)
+
+	tests := []struct {
+		input      string
+		shouldErr  bool
+		exempt     []string
+		blocked    []string
+		listReload time.Duration
+	}{
+		{input: `rrl`,
+			shouldErr:  false,
+			listReload: 5 * time.Second,
+		},
+		{input: `rrl {
+                   exempt-file ` + exemptPath + `
+                   block-file ` + blockPath + `
+                   list-reload 30s
+                 }`,
+			shouldErr:  false,
+			exempt:     []string{"10.0.0.1"},
+			blocked:    []string{"192.0.2.1"},
+			listReload: 30 * time.Second,
+		},
+		{input: `rrl {
+                   exempt-file ` + filepath.Join(dir, "missing.txt") + `
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   block-file ` + blockPath + `
+                   block-file ` + blockPath + `
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   block-file
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   list-reload -1s
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   list-reload often
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		for _, ip := range test.exempt {
+			if !rrl.exempt(net.ParseIP(ip)) {
+				t.Errorf("Test %v: Expected %v to be exempt", i, ip)
+			}
+		}
+		for _, ip := range test.blocked {
+			if !rrl.blocked(net.ParseIP(ip)) {
+				t.Errorf("Test %v: Expected %v to be blocked", i, ip)
+			}
+		}
+		if rrl.listReload != test.listReload {
+			t.Errorf("Test %v: Expected listReload %v but found: %v", i, test.listReload, rrl.listReload)
+		}
+	}
+}
+
+func TestSetupStateFile(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  string
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+		},
+		{input: `rrl {
+                   state-file /var/lib/coredns/rrl.state
+                 }`,
+			shouldErr: false,
+			expected:  "/var/lib/coredns/rrl.state",
+		},
+		{input: `rrl {
+                   state-file
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   state-file a b
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
 
 		if test.shouldErr && err == nil {
 			t.Errorf("Test %v: Expected error but found nil", i)
@@ -520,5 +870,1128 @@ func TestSetupInvalidOption(t *testing.T) {
 		if test.shouldErr && err != nil {
 			continue
 		}
+
+		if rrl.stateFile != test.expected {
+			t.Errorf("Test %v: Expected stateFile %v but found: %v", i, test.expected, rrl.stateFile)
+		}
+	}
+}
+
+func TestSetupAdmin(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  string
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+		},
+		{input: `rrl {
+                   admin 127.0.0.1:9154
+                 }`,
+			shouldErr: false,
+			expected:  "127.0.0.1:9154",
+		},
+		{input: `rrl {
+                   admin 127.0.0.1
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   admin
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if rrl.adminAddr != test.expected {
+			t.Errorf("Test %v: Expected adminAddr %v but found: %v", i, test.expected, rrl.adminAddr)
+		}
+	}
+}
+
+func TestSetupZonePolicies(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  map[string]policy
+	}{
+		{input: `rrl . {
+                   responses-per-second 10
+                   zone example.org {
+                     responses-per-second 5
+                     window 5
+                   }
+                   zone example.net example.com {
+                     nxdomains-per-second 2
+                     slip-ratio 2
+                   }
+                   slip-ratio 1
+                 }`,
+			shouldErr: false,
+			expected: map[string]policy{
+				".": {
+					window:            15 * second,
+					responsesInterval: second / 10,
+					nodataInterval:    second / 10,
+					nxdomainsInterval: second / 10,
+					referralsInterval: second / 10,
+					errorsInterval:    second / 10,
+					slipRatio:         1,
+				},
+				"example.org.": {
+					window:            5 * second,
+					responsesInterval: second / 5,
+					nodataInterval:    second / 5,
+					nxdomainsInterval: second / 5,
+					referralsInterval: second / 5,
+					errorsInterval:    second / 5,
+					slipRatio:         1,
+				},
+				"example.net.": {
+					window:            15 * second,
+					responsesInterval: second / 10,
+					nodataInterval:    second / 10,
+					nxdomainsInterval: second / 2,
+					referralsInterval: second / 10,
+					errorsInterval:    second / 10,
+					slipRatio:         2,
+				},
+				"example.com.": {
+					window:            15 * second,
+					responsesInterval: second / 10,
+					nodataInterval:    second / 10,
+					nxdomainsInterval: second / 2,
+					referralsInterval: second / 10,
+					errorsInterval:    second / 10,
+					slipRatio:         2,
+				},
+			},
+		},
+		{input: `rrl example.org {
+                   zone example.com {
+                     responses-per-second 5
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl . {
+                   zone example.org {
+                     responses-per-second 5
+                   }
+                   zone example.org {
+                     responses-per-second 6
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl . {
+                   zone example.org {
+                     max-table-size 5
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		// the closing brace must be on a line of its own, or it is taken as an argument of the last option
+		{input: `rrl . {
+                   zone example.org { responses-per-second 5 }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl . {
+                   zone example.org {
+                     responses-per-second -1
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl . {
+                   zone {
+                     responses-per-second 5
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl . {
+                   zone example.org
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		for zone, expected := range test.expected {
+			got := rrl.policyForZone("www." + zone)
+			if !reflect.DeepEqual(*got, expected) {
+				t.Errorf("Test %v: Expected policy %+v for zone %v but found: %+v", i, expected, zone, *got)
+			}
+		}
+	}
+}
+
+func TestSetupQtypeAllowances(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  map[uint16]int64
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+		},
+		{input: `rrl {
+                   qtype-per-second ANY 1
+                   qtype-per-second dnskey 2
+                   qtype-per-second TXT 0
+                 }`,
+			shouldErr: false,
+			expected: map[uint16]int64{
+				dns.TypeANY:    second,
+				dns.TypeDNSKEY: second / 2,
+				dns.TypeTXT:    0,
+			},
+		},
+		{input: `rrl {
+                   qtype-per-second ANY 1
+                   qtype-per-second ANY 2
+                 }`,
+			shouldErr: false,
+			expected: map[uint16]int64{
+				dns.TypeANY: second / 2,
+			},
+		},
+		{input: `rrl {
+                   qtype-per-second ANY
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   qtype-per-second BOGUS 1
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   qtype-per-second ANY -1
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   qtype-per-second ANY 1 2
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if !reflect.DeepEqual(rrl.qtypeIntervals, test.expected) {
+			t.Errorf("Test %v: Expected qtypeIntervals %v but found: %v", i, test.expected, rrl.qtypeIntervals)
+		}
+	}
+}
+
+func TestSetupBytesPerSecond(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  map[uint8]int64
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+		},
+		{input: `rrl {
+                   bytes-per-second responses 20000
+                   bytes-per-second nxdomains 5000
+                   bytes-per-second errors 0
+                 }`,
+			shouldErr: false,
+			expected: map[uint8]int64{
+				rTypeResponse: 20000,
+				rTypeNxdomain: 5000,
+				rTypeError:    0,
+			},
+		},
+		{input: `rrl {
+                   bytes-per-second responses
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   bytes-per-second answers 100
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   bytes-per-second responses -1
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   bytes-per-second responses 1.5
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if !reflect.DeepEqual(rrl.bytesPerSecond, test.expected) {
+			t.Errorf("Test %v: Expected bytesPerSecond %v but found: %v", i, test.expected, rrl.bytesPerSecond)
+		}
+	}
+}
+
+func TestSetupBurst(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  map[uint8]int64
+		credit    int64
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+			credit:    second,
+		},
+		{input: `rrl {
+                   responses-per-second 10
+                   nxdomains-per-second 5
+                   burst responses 50
+                   burst nxdomains 2
+                 }`,
+			shouldErr: false,
+			expected: map[uint8]int64{
+				rTypeResponse: 50,
+				rTypeNxdomain: 2,
+			},
+			credit: 5 * second,
+		},
+		{input: `rrl {
+                   responses-per-second 10
+                   qtype-per-second ANY 1
+                   burst responses 50
+                 }`,
+			shouldErr: false,
+			expected:  map[uint8]int64{rTypeResponse: 50},
+			credit:    50 * second,
+		},
+		{input: `rrl {
+                   bytes-per-second responses 1000
+                   burst responses 20000
+                 }`,
+			shouldErr: false,
+			expected:  map[uint8]int64{rTypeResponse: 20000},
+			credit:    20 * second,
+		},
+		{input: `rrl {
+                   burst responses
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   burst answers 10
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   burst responses 0
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   burst responses 1000001
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   burst responses 1.5
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   responses-per-second 0.001
+                   burst responses 1000000
+                 }`,
+			shouldErr: false,
+			expected:  map[uint8]int64{rTypeResponse: 1000000},
+			credit:    1000000 * 1000 * second,
+		},
+		{input: `rrl {
+                   responses-per-second 0.0000001
+                   burst responses 1000000
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   qtype-per-second ANY 0.0000001
+                   burst responses 1000000
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl . {
+                   burst nxdomains 1000000
+                   zone example.org {
+                     nxdomains-per-second 0.0000001
+                   }
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if !reflect.DeepEqual(rrl.bursts, test.expected) {
+			t.Errorf("Test %v: Expected bursts %v but found: %v", i, test.expected, rrl.bursts)
+		}
+		if credit := rrl.maxCredit(); credit != test.credit {
+			t.Errorf("Test %v: Expected max credit %v but found: %v", i, test.credit, credit)
+		}
+	}
+}
+
+func TestSetupSustained(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  map[uint8]sustainedLimit
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+		},
+		{input: `rrl {
+                   responses-per-second 20
+                   sustained-per-second responses 5 60s
+                   sustained-per-second nxdomains 0.5 10m
+                 }`,
+			shouldErr: false,
+			expected: map[uint8]sustainedLimit{
+				rTypeResponse: {interval: second / 5, period: 60 * second},
+				rTypeNxdomain: {interval: 2 * second, period: 600 * second},
+			},
+		},
+		{input: `rrl {
+                   sustained-per-second responses 5
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   sustained-per-second answers 5 60s
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   sustained-per-second responses 0 60s
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   sustained-per-second responses -5 60s
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   sustained-per-second responses 5 60
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   sustained-per-second responses 5 500ms
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   sustained-per-second responses 0.01 60s
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if !reflect.DeepEqual(rrl.sustained, test.expected) {
+			t.Errorf("Test %v: Expected sustained %v but found: %v", i, test.expected, rrl.sustained)
+		}
+	}
+}
+
+func TestSetupInvalidOption(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  RRL
+	}{
+		{input: `rrl {
+                   blah
+                 }`,
+			shouldErr: true,
+			expected:  RRL{},
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+	}
+}
+
+func TestSetupLogDrops(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  *dropLogger
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+		},
+		{input: `rrl {
+                   log-drops
+                 }`,
+			shouldErr: false,
+			expected:  &dropLogger{sample: 1},
+		},
+		{input: `rrl {
+                   log-drops json
+                 }`,
+			shouldErr: false,
+			expected:  &dropLogger{json: true, sample: 1},
+		},
+		{input: `rrl {
+                   log-drops text sample 100
+                 }`,
+			shouldErr: false,
+			expected:  &dropLogger{sample: 100},
+		},
+		{input: `rrl {
+                   log-drops sample 10 json
+                 }`,
+			shouldErr: false,
+			expected:  &dropLogger{json: true, sample: 10},
+		},
+		{input: `rrl {
+                   log-drops sample
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   log-drops sample 0
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   log-drops xml
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   log-drops
+                   log-drops json
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if !reflect.DeepEqual(rrl.dropLog, test.expected) {
+			t.Errorf("Test %v: Expected dropLog %+v but found: %+v", i, test.expected, rrl.dropLog)
+		}
+	}
+}
+
+func TestSetupMetricsLabels(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  int
+		topK      int
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+			expected:  labelIP,
+		},
+		{input: `rrl {
+                   metrics-labels ip
+                 }`,
+			shouldErr: false,
+			expected:  labelIP,
+		},
+		{input: `rrl {
+                   metrics-labels prefix
+                 }`,
+			shouldErr: false,
+			expected:  labelPrefix,
+		},
+		{input: `rrl {
+                   metrics-labels top 100
+                 }`,
+			shouldErr: false,
+			expected:  labelTop,
+			topK:      100,
+		},
+		{input: `rrl {
+                   metrics-labels top
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   metrics-labels top 0
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   metrics-labels prefix 10
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   metrics-labels qname
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   metrics-labels
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if rrl.metricsLabels != test.expected {
+			t.Errorf("Test %v: Expected metricsLabels %v but found: %v", i, test.expected, rrl.metricsLabels)
+		}
+		if test.topK != 0 && (rrl.topClients == nil || rrl.topClients.k != test.topK) {
+			t.Errorf("Test %v: Expected top %v clients but found: %+v", i, test.topK, rrl.topClients)
+		}
+	}
+}
+
+func TestSetupOnTableFull(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  uint8
+		zone      uint8
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+			expected:  tableFullAllow,
+		},
+		{input: `rrl {
+                   on-table-full drop
+                 }`,
+			shouldErr: false,
+			expected:  tableFullDrop,
+			zone:      tableFullDrop,
+		},
+		{input: `rrl . {
+                   on-table-full slip
+                   zone example.org {
+                     on-table-full allow
+                   }
+                 }`,
+			shouldErr: false,
+			expected:  tableFullSlip,
+			zone:      tableFullAllow,
+		},
+		{input: `rrl {
+                   on-table-full refuse
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   on-table-full
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if rrl.onTableFull != test.expected {
+			t.Errorf("Test %v: Expected onTableFull %v but found: %v", i, test.expected, rrl.onTableFull)
+		}
+		if p := rrl.policyForZone("www.example.org."); p.onTableFull != test.zone {
+			t.Errorf("Test %v: Expected zone onTableFull %v but found: %v", i, test.zone, p.onTableFull)
+		}
+	}
+}
+
+func TestSetupStore(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  *gossipStore
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+		},
+		{input: `rrl {
+                   store local
+                 }`,
+			shouldErr: false,
+		},
+		{input: `rrl {
+                   store gossip {
+                     listen :9155
+                     peers 10.0.0.2:9155 10.0.0.3:9155
+                     secret s3cr3t
+                   }
+                 }`,
+			shouldErr: false,
+			expected:  &gossipStore{listen: ":9155", peers: []string{"10.0.0.2:9155", "10.0.0.3:9155"}, interval: time.Second, secret: []byte("s3cr3t")},
+		},
+		{input: `rrl {
+                   store gossip {
+                     listen 10.0.0.1:9155
+                     peers 10.0.0.2:9155
+                     peers 10.0.0.3:9155
+                     interval 200ms
+                     secret s3cr3t
+                   }
+                   responses-per-second 10
+                 }`,
+			shouldErr: false,
+			expected: &gossipStore{listen: "10.0.0.1:9155", peers: []string{"10.0.0.2:9155", "10.0.0.3:9155"},
+				interval: 200 * time.Millisecond, secret: []byte("s3cr3t")},
+		},
+		{input: `rrl {
+                   store gossip
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   store gossip {
+                     peers 10.0.0.2:9155
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   store gossip {
+                     listen :9155
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   store gossip {
+                     listen :9155
+                     peers 10.0.0.2:9155
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   store gossip {
+                     listen :9155
+                     peers 10.0.0.2:9155
+                     secret ""
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   store gossip {
+                     listen :9155
+                     peers 10.0.0.2
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   store gossip {
+                     listen :9155
+                     peers 10.0.0.2:9155
+                     interval 0s
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   store gossip {
+                     listen :9155
+                     peers 10.0.0.2:9155
+                     gossip harder
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   store redis
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   store
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if test.expected == nil {
+			if _, ok := rrl.table.(*cache.Cache[cache.Key, *ResponseAccount]); !ok {
+				t.Errorf("Test %v: Expected local store but found: %T", i, rrl.table)
+			}
+			continue
+		}
+		g, ok := rrl.table.(*gossipStore)
+		if !ok {
+			t.Errorf("Test %v: Expected gossip store but found: %T", i, rrl.table)
+			continue
+		}
+		if g.listen != test.expected.listen || !reflect.DeepEqual(g.peers, test.expected.peers) ||
+			g.interval != test.expected.interval || string(g.secret) != string(test.expected.secret) {
+			t.Errorf("Test %v: Expected gossip store %+v but found: %+v", i, test.expected, g)
+		}
+	}
+}
+
+func TestSetupTableShards(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  int
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+			expected:  cache.DefaultShards,
+		},
+		{input: `rrl {
+                   table-shards 1024
+                 }`,
+			shouldErr: false,
+			expected:  1024,
+		},
+		{input: `rrl {
+                   table-shards 1
+                 }`,
+			shouldErr: false,
+			expected:  1,
+		},
+		{input: `rrl {
+                   table-shards 0
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   table-shards 100
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   table-shards -4
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   table-shards many
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   table-shards
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if rrl.tableShards != test.expected {
+			t.Errorf("Test %v: Expected tableShards %v but found: %v", i, test.expected, rrl.tableShards)
+		}
+	}
+}
+
+func TestSetupSweepInterval(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  time.Duration
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+			expected:  30 * time.Second,
+		},
+		{input: `rrl {
+                   sweep-interval 1m
+                 }`,
+			shouldErr: false,
+			expected:  time.Minute,
+		},
+		{input: `rrl {
+                   sweep-interval 0
+                 }`,
+			shouldErr: false,
+			expected:  0,
+		},
+		{input: `rrl {
+                   sweep-interval -1s
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   sweep-interval often
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if rrl.sweepInterval != test.expected {
+			t.Errorf("Test %v: Expected sweepInterval %v but found: %v", i, test.expected, rrl.sweepInterval)
+		}
+	}
+}
+
+func TestSetupTableMode(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  uint8
+	}{
+		{input: `rrl`,
+			shouldErr: false,
+			expected:  tableModeExact,
+		},
+		{input: `rrl {
+                   table-mode exact
+                 }`,
+			shouldErr: false,
+			expected:  tableModeExact,
+		},
+		{input: `rrl {
+                   table-mode sketch
+                 }`,
+			shouldErr: false,
+			expected:  tableModeSketch,
+		},
+		{input: `rrl {
+                   table-mode sketch
+                   store local
+                 }`,
+			shouldErr: false,
+			expected:  tableModeSketch,
+		},
+		{input: `rrl {
+                   table-mode sketch
+                   store gossip {
+                     listen :9155
+                     peers 10.0.0.2:9155
+                     secret s3cr3t
+                   }
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   table-mode approximate
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   table-mode
+                 }`,
+			shouldErr: true,
+		},
+		{input: `rrl {
+                   table-mode exact sketch
+                 }`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		rrl, err := rrlParse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr && err != nil {
+			continue
+		}
+
+		if rrl.tableMode != test.expected {
+			t.Errorf("Test %v: Expected tableMode %v but found: %v", i, test.expected, rrl.tableMode)
+		}
+		if (rrl.sketch != nil) != (test.expected == tableModeSketch) {
+			t.Errorf("Test %v: Expected a sketch only in sketch mode, found %v", i, rrl.sketch)
+		}
 	}
 }
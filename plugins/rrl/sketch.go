@@ -0,0 +1,104 @@
+package rrl
+
+import (
+	"sync/atomic"
+
+	"github.com/coredns/rrl/plugins/rrl/cache"
+)
+
+// Table modes, set by table-mode
+const (
+	tableModeExact  = 0
+	tableModeSketch = 1
+)
+
+// sketchDepth is the number of rows of a sketch, each indexing a token with a different hash
+const sketchDepth = 4
+
+// sketch is a count-min sketch of the allowance used by tokens, decaying over time, for accounting in constant memory.
+// Each cell holds the allow time of the tokens that index it, in the same way as the allowTime of a ResponseAccount,
+// so that a cell recovers credit over time as an account does. A token is debited in each of its cells, and its
+// balance is that of its least indebted cell. Since a cell is shared by several tokens, a token can appear more
+// indebted than it is, but never less, so heavy hitters are always limited, and a light token is limited only when
+// each of its cells is shared with heavy tokens.
+type sketch struct {
+	cells     []int64  // sketchDepth rows of width allow times
+	sustained []int64  // the allow times of sustained buckets, in the same layout as cells, or nil
+	slips     []uint32 // slip countdowns, indexed by the first row of a token
+	mask      uint64   // selects a column of a row, the width less one
+}
+
+// newSketch returns a sketch of about size cells, with as many for sustained buckets if sustained is true
+func newSketch(size int, sustained bool) *sketch {
+	width := 1
+	for width*sketchDepth < size {
+		width <<= 1
+	}
+	s := &sketch{
+		cells: make([]int64, sketchDepth*width),
+		slips: make([]uint32, width),
+		mask:  uint64(width - 1),
+	}
+	if sustained {
+		s.sustained = make([]int64, sketchDepth*width)
+	}
+	return s
+}
+
+// index returns the index of the cell of row i for a token with hash h. The column of each row is derived from the
+// two halves of the hash, which is as good as independent hashes.
+func (s *sketch) index(h uint64, i int) int {
+	h1, h2 := h&0xffffffff, h>>32|1
+	return i*len(s.slips) + int((h1+uint64(i)*h2)&s.mask)
+}
+
+// debit debits allowance from the token t at time now, and returns the new balance, and whether a limited response
+// should slip. As for an account, a response is also debited from the sustained bucket of its type, if it has a
+// sustained limit, and the balance is the lower of the two.
+func (s *sketch) debit(p *policy, allowance int64, t cache.Key, now int64) (int64, bool) {
+	h := t.Hash()
+	var idx [sketchDepth]int
+	for i := range idx {
+		idx[i] = s.index(h, i)
+	}
+	// as for an account, the credit is raised to the cost of a response larger than the bytes-per-second budget
+	balance := drawCells(s.cells, &idx, allowance, max(p.creditForQtype(t.Type, t.Qtype), allowance), p.window, now)
+	if sl, ok := p.sustained[t.Type]; ok && s.sustained != nil {
+		balance = min(balance, drawCells(s.sustained, &idx, sl.interval, sl.period, p.window, now))
+	}
+	if balance > 0 || p.slipRatio == 0 {
+		return balance, false
+	}
+	// a countdown of 0 has not been started, since slipping is enabled
+	countdown := &s.slips[idx[0]]
+	atomic.CompareAndSwapUint32(countdown, 0, p.slipRatio)
+	return balance, slip(countdown, p.slipRatio)
+}
+
+// drawCells debits allowance from the cells idx of a token, and returns its new balance at time now. The balance can't
+// exceed credit, nor be more negative than window. Cells are only raised as far as the new allow time of the token
+// (conservative update), to limit the debt shared with other tokens.
+func drawCells(cells []int64, idx *[sketchDepth]int, allowance, credit, window, now int64) int64 {
+	allowTime := atomic.LoadInt64(&cells[idx[0]])
+	for _, i := range idx[1:] {
+		allowTime = min(allowTime, atomic.LoadInt64(&cells[i]))
+	}
+	balance := now - allowTime - allowance
+	if balance >= credit {
+		// positive balance can't exceed the credit, 1 second unless raised by burst
+		balance = credit - allowance
+	} else if balance < -window {
+		// balance can't be more negative than window
+		balance = -window
+	}
+	allowTime = now - balance
+	for _, i := range idx {
+		for {
+			a := atomic.LoadInt64(&cells[i])
+			if a >= allowTime || atomic.CompareAndSwapInt64(&cells[i], a, allowTime) {
+				break
+			}
+		}
+	}
+	return balance
+}
@@ -0,0 +1,268 @@
+package rrl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/coredns/rrl/plugins/rrl/cache"
+)
+
+func TestSketchDebit(t *testing.T) {
+	p := &policy{window: 5 * second, slipRatio: 2}
+	s := newSketch(1000, false)
+	token := testToken("token1")
+	now := int64(1000 * second)
+
+	// a new token starts with one second of credit
+	if bal, _ := s.debit(p, second/10, token, now); bal != second-second/10 {
+		t.Errorf("expected balance of %v, got %v", second-second/10, bal)
+	}
+	if bal, _ := s.debit(p, second/10, token, now); bal != second-2*second/10 {
+		t.Errorf("expected balance of %v, got %v", second-2*second/10, bal)
+	}
+
+	// debt is bounded by the window, and limited responses slip every slipRatio
+	slips := 0
+	for i := 0; i < 100; i++ {
+		if _, slip := s.debit(p, second/10, token, now); slip {
+			slips++
+		}
+	}
+	if bal, _ := s.debit(p, second/10, token, now); bal != -p.window {
+		t.Errorf("expected balance of %v, got %v", -p.window, bal)
+	}
+	if limited := 100 - 7; slips != limited/2 {
+		t.Errorf("expected %d slips, got %d", limited/2, slips)
+	}
+
+	// credit is earned back over time, up to one second
+	now += p.window + 2*second
+	if bal, _ := s.debit(p, second/10, token, now); bal != second-second/10 {
+		t.Errorf("expected balance of %v, got %v", second-second/10, bal)
+	}
+
+	// other tokens are not affected
+	if bal, _ := s.debit(p, second/10, testToken("token2"), now); bal != second-second/10 {
+		t.Errorf("expected balance of %v, got %v", second-second/10, bal)
+	}
+
+	// a response costing more than a second is allowed once the token has recovered its cost
+	big := testToken("token3")
+	for i := 0; i < 3; i++ {
+		if bal, _ := s.debit(p, 3*second, big, now); bal != 0 {
+			t.Errorf("expected balance of 0, got %v", bal)
+		}
+		if bal, _ := s.debit(p, 3*second, big, now); bal >= 0 {
+			t.Errorf("expected negative balance, got %v", bal)
+		}
+		now += 2*p.window + 3*second
+	}
+}
+
+func TestSketchSustained(t *testing.T) {
+	// 20 responses per second, and 5 per second averaged over 60 seconds
+	p := &policy{window: 15 * second, responsesInterval: second / 20}
+	p.sustained = map[uint8]sustainedLimit{rTypeResponse: {interval: second / 5, period: 60 * second}}
+	s := newSketch(1000, true)
+	token := testToken("token1")
+	start := int64(1000 * second)
+
+	// a steady stream of 10 responses per second is allowed until the sustained bucket is empty
+	allowed := 0
+	for now := start; now < start+120*second; now += second / 10 {
+		if bal, _ := s.debit(p, p.responsesInterval, token, now); bal >= 0 {
+			allowed++
+			if now > start+70*second {
+				t.Fatalf("expected responses to be limited after 70 seconds, got balance %v", bal)
+			}
+		}
+	}
+	if allowed < 500 {
+		t.Errorf("expected at least 500 responses allowed, got %d", allowed)
+	}
+
+	// without a sustained limit, the stream is never limited
+	p.sustained = nil
+	s = newSketch(1000, false)
+	for now := start; now < start+120*second; now += second / 10 {
+		if bal, _ := s.debit(p, p.responsesInterval, token, now); bal < 0 {
+			t.Fatalf("expected responses to be allowed without a sustained limit, got balance %v", bal)
+		}
+	}
+}
+
+// TestSketchAccuracy compares the sketch with exact accounts, for heavy hitters hidden in a flood of tokens that are
+// each seen once, e.g. responses to spoofed random clients. The sketch holds about max-table-size cells whatever the
+// number of tokens, and limits heavy hitters as exact accounts do, but once there are about as many heavy hitters as
+// columns in the sketch, most other tokens share each of their cells with one and are limited too.
+func TestSketchAccuracy(t *testing.T) {
+	const (
+		size     = 10000 // max-table-size
+		oneShots = 10    // one shot tokens per millisecond
+		millis   = 5000
+	)
+	p := &policy{window: 15 * second}
+	allowance := int64(second / 10)
+
+	tests := []struct {
+		heavy      int     // heavy hitters
+		heavyRate  int     // responses per millisecond, shared by the heavy hitters
+		minLimited float64 // the expected ratio of one shot tokens limited
+		maxLimited float64
+	}{
+		{heavy: 10, heavyRate: 1, maxLimited: 0.01},
+		{heavy: 1000, heavyRate: 20, maxLimited: 0.01},
+		{heavy: 10000, heavyRate: 200, minLimited: 0.5, maxLimited: 1},
+	}
+
+	for i, test := range tests {
+		s := newSketch(size, false)
+		exact := map[cache.Key]*ResponseAccount{}
+		debit := func(token cache.Key, now int64) (got, want int64) {
+			ra, found := exact[token]
+			if !found {
+				ra = &ResponseAccount{}
+				exact[token] = ra
+			}
+			want = draw(&ra.allowTime, allowance, second, p.window, now)
+			got, _ = s.debit(p, allowance, token, now)
+			return got, want
+		}
+
+		var heavyAllowed, heavyAllowedExact, oneShotsSeen, oneShotsLimited, overCredited int
+		h := 0
+		for ms := 0; ms < millis; ms++ {
+			now := 1000*second + int64(ms)*(second/1000)
+			for j := 0; j < test.heavyRate; j++ {
+				got, want := debit(testToken(fmt.Sprintf("heavy%d", h%test.heavy)), now)
+				h++
+				if got > want+allowance {
+					overCredited++
+				}
+				if got > 0 {
+					heavyAllowed++
+				}
+				if want > 0 {
+					heavyAllowedExact++
+				}
+			}
+			for j := 0; j < oneShots; j++ {
+				got, want := debit(testToken(fmt.Sprintf("oneshot%d", oneShotsSeen)), now)
+				oneShotsSeen++
+				if got > want+allowance {
+					overCredited++
+				}
+				if got <= 0 {
+					oneShotsLimited++
+				}
+			}
+		}
+
+		// a token is never given more credit than its exact account, less its allowance. A token new to the exact
+		// accounts can't have more than one second of credit before it is debited, while a token sharing its cells with
+		// another may be up to one allowance short of that.
+		if overCredited != 0 {
+			t.Errorf("Test %d: expected no balance above the exact balance, got %d", i, overCredited)
+		}
+		// so heavy hitters are limited at least as much as with exact accounts
+		if heavyAllowed > heavyAllowedExact {
+			t.Errorf("Test %d: expected at most %d heavy hitter responses allowed, as with exact accounts, got %d", i, heavyAllowedExact, heavyAllowed)
+		}
+		if l := len(exact); l < oneShotsSeen {
+			t.Errorf("Test %d: expected at least %d exact accounts, got %d", i, oneShotsSeen, l)
+		}
+		if rate := float64(oneShotsLimited) / float64(oneShotsSeen); rate < test.minLimited || rate > test.maxLimited {
+			t.Errorf("Test %d: expected between %v and %v of one shot tokens limited, got %v", i, test.minLimited, test.maxLimited, rate)
+		}
+	}
+}
+
+// TestSketchTableFull shows a flood of tokens filling the exact table of max-table-size, so that a heavy hitter
+// arriving later has no account and is not limited, while the sketch of the same size still limits it.
+func TestSketchTableFull(t *testing.T) {
+	for _, mode := range []uint8{tableModeExact, tableModeSketch} {
+		rrl := defaultRRL()
+		rrl.maxTableSize = 10000
+		rrl.responsesInterval = second / 10
+		rrl.tableMode = mode
+		if err := rrl.initTable(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2*rrl.maxTableSize; i++ {
+			rrl.debit(&rrl.policy, rrl.responsesInterval, testToken(fmt.Sprintf("oneshot%d", i)))
+		}
+
+		limited := 0
+		var err error
+		for i := 0; i < 100; i++ {
+			var bal int64
+			bal, _, err = rrl.debit(&rrl.policy, rrl.responsesInterval, testToken("heavy"))
+			if err != nil {
+				break
+			}
+			if bal <= 0 {
+				limited++
+			}
+		}
+		switch mode {
+		case tableModeExact:
+			if !errors.Is(err, cache.ErrShardFull) {
+				t.Errorf("expected %v for exact accounts, got %v", cache.ErrShardFull, err)
+			}
+		case tableModeSketch:
+			if err != nil {
+				t.Errorf("expected no error for the sketch, got %v", err)
+			}
+			if limited < 100-11 {
+				t.Errorf("expected at least %d of 100 responses limited, got %d", 100-11, limited)
+			}
+		}
+	}
+}
+
+// TestSketchTableMode shows that every debit goes to the sketch, and only amplification accounts to the table
+func TestSketchTableMode(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.tableMode = tableModeSketch
+	rrl.maxAmplification = 2
+	if err := rrl.initTable(); err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	for _, token := range []cache.Key{
+		rrl.buildToken(rTypeResponse, 1, "example.org.", ip),
+		rrl.buildToken(rTypeAll, 0, "", ip),
+		rrl.buildToken(rTypeRequest, 0, "", ip),
+	} {
+		if _, _, err := rrl.debit(&rrl.policy, second/10, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l := rrl.table.Len(); l != 0 {
+		t.Errorf("expected no accounts in the table, got %d", l)
+	}
+	if _, _, err := rrl.amplified(rrl.buildToken(rTypeAmplification, 0, "", ip), 50, 500); err != nil {
+		t.Fatal(err)
+	}
+	if l := rrl.table.Len(); l != 1 {
+		t.Errorf("expected the amplification account in the table, got %d accounts", l)
+	}
+}
+
+func BenchmarkSketchDebit(b *testing.B) {
+	p := &policy{window: 15 * second, slipRatio: 2}
+	s := newSketch(100000, false)
+	tokens := make([]cache.Key, 1024)
+	for i := range tokens {
+		tokens[i] = testToken(fmt.Sprintf("token%d", i))
+	}
+	now := int64(1000 * second)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.debit(p, second/10, tokens[i%len(tokens)], now+int64(i))
+	}
+}
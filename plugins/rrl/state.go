@@ -0,0 +1,141 @@
+package rrl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/coredns/rrl/plugins/rrl/cache"
+)
+
+// accountState is the serialized form of a ResponseAccount. Times are stored relative to the time
+// the state was saved, so that accounts resume with the same balances after a restart.
+type accountState struct {
+	Token          string `json:"token"`
+	AllowTime      int64  `json:"allow_time"`
+	SlipCountdown  uint32 `json:"slip_countdown"`
+	RequestBytes   int64  `json:"request_bytes,omitempty"`
+	ResponseBytes  int64  `json:"response_bytes,omitempty"`
+	AmplifiedSince *int64 `json:"amplified_since,omitempty"`
+
+	SustainedAllowTime *int64 `json:"sustained_allow_time,omitempty"`
+}
+
+// saveState writes every account in the table to the state file. The file is replaced atomically.
+func (rrl *RRL) saveState() error {
+	tmp := rrl.stateFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := rrl.writeState(f, time.Now().UnixNano())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, rrl.stateFile); err != nil {
+		return err
+	}
+	log.Infof("saved %d accounts to %v", n, rrl.stateFile)
+	return nil
+}
+
+// writeState writes every account in the table to w, one JSON object per line. It returns the number of accounts written.
+func (rrl *RRL) writeState(w io.Writer, now int64) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	var err error
+	rrl.table.Range(func(t cache.Key, ra *ResponseAccount) bool {
+		snap := ra.Snapshot()
+		s := accountState{
+			Token:         tokenString(t),
+			AllowTime:     snap.AllowTime - now,
+			SlipCountdown: snap.SlipCountdown,
+			RequestBytes:  snap.RequestBytes,
+			ResponseBytes: snap.ResponseBytes,
+		}
+		if snap.AmplifiedSince != 0 {
+			since := snap.AmplifiedSince - now
+			s.AmplifiedSince = &since
+		}
+		if snap.SustainedAllowTime != 0 {
+			sustained := snap.SustainedAllowTime - now
+			s.SustainedAllowTime = &sustained
+		}
+		if err = enc.Encode(s); err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// loadState adds the accounts in the state file to the table. A missing state file is not an error.
+func (rrl *RRL) loadState() error {
+	f, err := os.Open(rrl.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := rrl.readState(f, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	log.Infof("restored %d accounts from %v", n, rrl.stateFile)
+	return nil
+}
+
+// readState adds the accounts read from r to the table. Accounts that would have fully recovered by now are
+// skipped. It returns the number of accounts added.
+func (rrl *RRL) readState(r io.Reader, now int64) (int, error) {
+	expired := rrl.expiredFunc()
+	dec := json.NewDecoder(bufio.NewReader(r))
+	n := 0
+	for {
+		var s accountState
+		if err := dec.Decode(&s); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		t, err := parseTokenString(s.Token)
+		if err != nil {
+			// skip accounts saved in another token format
+			continue
+		}
+		ra := &ResponseAccount{
+			allowTime:     now + s.AllowTime,
+			slipCountdown: s.SlipCountdown,
+			requestBytes:  s.RequestBytes,
+			responseBytes: s.ResponseBytes,
+		}
+		if s.AmplifiedSince != nil {
+			ra.amplifiedSince = now + *s.AmplifiedSince
+		}
+		if s.SustainedAllowTime != nil {
+			ra.sustainedAllowTime = now + *s.SustainedAllowTime
+		}
+		if expired(ra, now) {
+			continue
+		}
+		if err := rrl.table.Add(t, ra); err != nil {
+			// the table is full, the remaining accounts are lost
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,95 @@
+package rrl
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.window = 5 * second
+	rrl.initTable()
+
+	now := time.Now().UnixNano()
+	rrl.table.Add(testToken("indebted"), &ResponseAccount{allowTime: now + 2*second, slipCountdown: 2})
+	rrl.table.Add(testToken("amplifier"), &ResponseAccount{allowTime: now, requestBytes: 100, responseBytes: 5000, amplifiedSince: now - second})
+	rrl.table.Add(testToken("recovered"), &ResponseAccount{allowTime: now - 10*second})
+	rrl.table.Add(testToken("sustained"), &ResponseAccount{allowTime: now - 10*second, sustainedAllowTime: now + second})
+
+	var buf bytes.Buffer
+	n, err := rrl.writeState(&buf, now)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("expected %v accounts written, got %v", 4, n)
+	}
+
+	// restore the state 3 seconds later into an empty table
+	later := now + 3*second
+	restored := defaultRRL()
+	restored.window = 5 * second
+	restored.initTable()
+	n, err = restored.readState(&buf, later)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected %v accounts restored, got %v", 3, n)
+	}
+
+	ra, found := restored.table.Get(testToken("indebted"))
+	if !found {
+		t.Fatalf("expected indebted account to be restored")
+	}
+	if ra.allowTime != later+2*second || ra.slipCountdown != 2 {
+		t.Errorf("expected allowTime %v and slipCountdown %v, got %v and %v", later+2*second, 2, ra.allowTime, ra.slipCountdown)
+	}
+
+	ra, found = restored.table.Get(testToken("amplifier"))
+	if !found {
+		t.Fatalf("expected amplifier account to be restored")
+	}
+	if ra.requestBytes != 100 || ra.responseBytes != 5000 || ra.amplifiedSince != later-second {
+		t.Errorf("unexpected amplification state restored: %+v", *ra)
+	}
+
+	// an account is restored while its sustained bucket is indebted
+	ra, found = restored.table.Get(testToken("sustained"))
+	if !found {
+		t.Fatalf("expected sustained account to be restored")
+	}
+	if ra.sustainedAllowTime != later+second {
+		t.Errorf("expected sustainedAllowTime %v, got %v", later+second, ra.sustainedAllowTime)
+	}
+
+	if _, found := restored.table.Get(testToken("recovered")); found {
+		t.Errorf("expected fully recovered account not to be restored")
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	rrl := defaultRRL()
+	rrl.stateFile = filepath.Join(t.TempDir(), "rrl.state")
+	rrl.initTable()
+
+	// a missing state file is not an error
+	if err := rrl.loadState(); err != nil {
+		t.Errorf("expected no error loading missing state file, got: %v", err)
+	}
+
+	rrl.table.Add(testToken("token1"), &ResponseAccount{allowTime: time.Now().UnixNano() + second})
+	if err := rrl.saveState(); err != nil {
+		t.Fatalf("expected no error saving state, got: %v", err)
+	}
+
+	rrl.initTable()
+	if err := rrl.loadState(); err != nil {
+		t.Fatalf("expected no error loading state, got: %v", err)
+	}
+	if _, found := rrl.table.Get(testToken("token1")); !found {
+		t.Errorf("expected account to be restored")
+	}
+}
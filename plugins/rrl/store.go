@@ -0,0 +1,108 @@
+package rrl
+
+import (
+	"sync"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/rrl/plugins/rrl/cache"
+)
+
+// Store holds the response accounts of an rrl block. The default store is a *cache.Cache, holding accounts in
+// memory. Accounts are debited concurrently, through Use for accounts that exist, and UpdateAdd for accounts that
+// may need to be added.
+type Store interface {
+	// Use returns the account of key, if it exists, to be updated concurrently
+	Use(key cache.Key) (*ResponseAccount, bool)
+	// UpdateAdd replaces the account of key with the result of update, or adds the account returned by add if it
+	// does not exist. It returns the account stored, or an error if it could not be added.
+	UpdateAdd(key cache.Key, update func(*ResponseAccount) *ResponseAccount, add func() *ResponseAccount) (*ResponseAccount, error)
+	// Get returns the account of key, if it exists
+	Get(key cache.Key) (*ResponseAccount, bool)
+	// Add adds the account of key, replacing any existing account
+	Add(key cache.Key, ra *ResponseAccount) error
+	// Remove removes the account of key
+	Remove(key cache.Key)
+	// Range calls f for each account until f returns false
+	Range(f func(key cache.Key, ra *ResponseAccount) bool)
+	// RemoveFunc removes each account for which f returns true, and returns the number removed
+	RemoveFunc(f func(key cache.Key, ra *ResponseAccount) bool) int
+
+	// SetEvict sets the function returning whether an account may be evicted, to make room for another or by Expire
+	SetEvict(e cache.EvictFn[*ResponseAccount])
+	// Expire removes accounts that may be evicted, and returns the number removed
+	Expire() int
+	// Evictions returns the number of accounts evicted to make room for others
+	Evictions() uint64
+	// Len returns the number of accounts
+	Len() int
+	// Cap returns the most accounts the store can hold
+	Cap() int
+}
+
+// DebitObserver is implemented by stores that are told of each debit, e.g. to share it with other instances.
+type DebitObserver interface {
+	// Debited is called after allowance is debited from the account of key
+	Debited(key cache.Key, allowance int64)
+}
+
+// StoreService is implemented by stores that run in the background. Start is called when the server starts, and
+// Stop when it shuts down or reloads.
+type StoreService interface {
+	Start() error
+	Stop() error
+}
+
+// StoreOptions are the options of the rrl block that a store is created with.
+type StoreOptions struct {
+	MaxSize   int    // the maximum number of accounts, set by max-table-size
+	Shards    int    // the number of shards, set by table-shards
+	Window    int64  // the longest window of the rrl block, in nanoseconds
+	MaxCredit int64  // the most credit an account can hold, in nanoseconds, one second unless raised by burst
+	SlipRatio uint32 // the slip ratio of new accounts
+}
+
+// StoreType parses the arguments and block of a `store TYPE` directive, and returns a function that creates the
+// store once the rest of the rrl block has been parsed.
+type StoreType func(c *caddy.Controller) (func(o StoreOptions) (Store, error), error)
+
+var (
+	storeTypes   = map[string]StoreType{}
+	storeTypesMu sync.RWMutex
+)
+
+// RegisterStore registers a store type, to be selected with `store name`. It is meant to be called from the init
+// function of the package implementing the store, and panics if name is already registered.
+func RegisterStore(name string, t StoreType) {
+	storeTypesMu.Lock()
+	defer storeTypesMu.Unlock()
+	if _, ok := storeTypes[name]; ok {
+		panic("rrl: store type " + name + " registered twice")
+	}
+	storeTypes[name] = t
+}
+
+// lookupStore returns the store type registered as name
+func lookupStore(name string) (StoreType, bool) {
+	storeTypesMu.RLock()
+	defer storeTypesMu.RUnlock()
+	t, ok := storeTypes[name]
+	return t, ok
+}
+
+func init() {
+	RegisterStore("local", parseLocalStore)
+	RegisterStore("gossip", parseGossipStore)
+}
+
+// parseLocalStore parses `store local`, the default store
+func parseLocalStore(c *caddy.Controller) (func(StoreOptions) (Store, error), error) {
+	if len(c.RemainingArgs()) != 0 {
+		return nil, c.ArgErr()
+	}
+	return newLocalStore, nil
+}
+
+// newLocalStore returns a store holding accounts in memory
+func newLocalStore(o StoreOptions) (Store, error) {
+	return cache.NewWithShards[cache.Key, *ResponseAccount](o.MaxSize, o.Shards), nil
+}
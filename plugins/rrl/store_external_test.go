@@ -0,0 +1,120 @@
+package rrl_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/rrl/plugins/rrl"
+	"github.com/coredns/rrl/plugins/rrl/cache"
+
+	"github.com/miekg/dns"
+)
+
+// sharedAccounts stands in for a database shared by the instances using mirrorStore
+type sharedAccounts struct {
+	sync.Mutex
+	accounts map[cache.Key]rrl.AccountState
+}
+
+var shared = &sharedAccounts{accounts: map[cache.Key]rrl.AccountState{}}
+
+// mirrorStore is a store implemented outside of the rrl package. It copies each debited account to the shared
+// accounts, and starts with the accounts copied by other instances.
+type mirrorStore struct {
+	rrl.Store
+}
+
+func (s *mirrorStore) Debited(key cache.Key, _ int64) {
+	if ra, found := s.Get(key); found {
+		shared.Lock()
+		shared.accounts[key] = ra.Snapshot()
+		shared.Unlock()
+	}
+}
+
+func init() {
+	rrl.RegisterStore("mirror", func(c *caddy.Controller) (func(rrl.StoreOptions) (rrl.Store, error), error) {
+		if len(c.RemainingArgs()) != 0 {
+			return nil, c.ArgErr()
+		}
+		return func(o rrl.StoreOptions) (rrl.Store, error) {
+			local := cache.NewWithShards[cache.Key, *rrl.ResponseAccount](o.MaxSize, o.Shards)
+			shared.Lock()
+			defer shared.Unlock()
+			for key, state := range shared.accounts {
+				ra := new(rrl.ResponseAccount)
+				ra.Restore(state)
+				if err := local.Add(key, ra); err != nil {
+					return nil, err
+				}
+			}
+			return &mirrorStore{Store: local}, nil
+		}, nil
+	})
+}
+
+// newMirrorInstance sets up an instance of the rrl plugin using mirrorStore, the way the server does
+func newMirrorInstance(t *testing.T) plugin.Handler {
+	t.Helper()
+	c := caddy.NewTestController("dns", `rrl example.org {
+                   store mirror
+                   window 10
+                   responses-per-second 1
+                   slip-ratio 0
+                 }`)
+	setup, err := caddy.DirectiveAction("dns", "rrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error but found error: %v", err)
+	}
+	plugins := dnsserver.GetConfig(c).Plugin
+	return plugins[len(plugins)-1](test.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{test.A("example.org. 300 IN A 192.0.2.53")}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	}))
+}
+
+func TestExternalStore(t *testing.T) {
+	query := func(h plugin.Handler) bool {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		h.ServeDNS(context.TODO(), w, m)
+		return w.Msg != nil
+	}
+
+	// the first instance answers one response per second of credit, and copies its account to the shared accounts
+	a := newMirrorInstance(t)
+	if !query(a) {
+		t.Fatal("Expected the first response to be answered")
+	}
+	for i := 0; i < 5; i++ {
+		query(a)
+	}
+	if query(a) {
+		t.Fatal("Expected responses over the allowance to be dropped")
+	}
+	shared.Lock()
+	n := len(shared.accounts)
+	shared.Unlock()
+	if n != 1 {
+		t.Fatalf("Expected 1 shared account, found %d", n)
+	}
+
+	// a second instance restores the account, so the client is still limited
+	b := newMirrorInstance(t)
+	if query(b) {
+		t.Error("Expected the restored account to be limited")
+	}
+}
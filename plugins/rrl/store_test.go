@@ -0,0 +1,81 @@
+package rrl
+
+import (
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/rrl/plugins/rrl/cache"
+)
+
+// countingStore is a store that counts debits, for testing stores registered by other packages
+type countingStore struct {
+	Store
+	opts    StoreOptions
+	arg     string
+	debited int64
+}
+
+func (s *countingStore) Debited(_ cache.Key, allowance int64) { s.debited += allowance }
+
+func TestRegisterStore(t *testing.T) {
+	var created *countingStore
+	t.Cleanup(func() {
+		storeTypesMu.Lock()
+		delete(storeTypes, "counting")
+		storeTypesMu.Unlock()
+	})
+	RegisterStore("counting", func(c *caddy.Controller) (func(StoreOptions) (Store, error), error) {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return nil, c.ArgErr()
+		}
+		return func(o StoreOptions) (Store, error) {
+			local, err := newLocalStore(o)
+			if err != nil {
+				return nil, err
+			}
+			created = &countingStore{Store: local, opts: o, arg: args[0]}
+			return created, nil
+		}, nil
+	})
+
+	// the store is created with options set after the store directive
+	c := caddy.NewTestController("dns", `rrl {
+                   store counting foo
+                   max-table-size 500
+                   table-shards 4
+                   window 20
+                   responses-per-second 10
+                   slip-ratio 3
+                 }`)
+	rrl, err := rrlParse(c)
+	if err != nil {
+		t.Fatalf("Expected no error but found error: %v", err)
+	}
+	if rrl.table != Store(created) {
+		t.Fatalf("Expected the registered store to be the table, found %T", rrl.table)
+	}
+	if expected := (StoreOptions{MaxSize: 500, Shards: 4, Window: 20 * second, MaxCredit: second, SlipRatio: 3}); created.opts != expected || created.arg != "foo" {
+		t.Errorf("Expected store options %+v and argument foo, found %+v and %v", expected, created.opts, created.arg)
+	}
+
+	// the store is told of debits
+	rrl.debit(&rrl.policy, rrl.responsesInterval, testToken("a"))
+	rrl.debit(&rrl.policy, rrl.responsesInterval, testToken("a"))
+	if created.debited != 2*rrl.responsesInterval {
+		t.Errorf("Expected %v debited, found %v", 2*rrl.responsesInterval, created.debited)
+	}
+
+	if _, err := rrlParse(caddy.NewTestController("dns", `rrl {
+                   store counting
+                 }`)); err == nil {
+		t.Error("Expected error from the store type but found nil")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a store type twice to panic")
+		}
+	}()
+	RegisterStore("counting", nil)
+}
@@ -0,0 +1,34 @@
+package rrl
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Actions taken on a response when its account cannot be added because the table is full
+const (
+	tableFullAllow = iota // write the response, the default
+	tableFullDrop         // drop the response
+	tableFullSlip         // write the response truncated
+)
+
+// tableFullLogInterval is the minimum interval between logs of failures to add accounts to the full table
+const tableFullLogInterval = 10 * time.Second
+
+// tableFullLog counts failures to add accounts to the full table, logging them at most once per tableFullLogInterval
+type tableFullLog struct {
+	last  int64 // unix nanoseconds of the last log
+	count int64 // failures since the last log
+}
+
+// log counts a failure, logging the failures counted since the last log if it is time to
+func (l *tableFullLog) log() {
+	atomic.AddInt64(&l.count, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&l.last)
+	if now-last < int64(tableFullLogInterval) || !atomic.CompareAndSwapInt64(&l.last, last, now) {
+		return
+	}
+	n := atomic.SwapInt64(&l.count, 0)
+	log.Warningf("table is full, %d accounts could not be added since the last warning; consider increasing max-table-size", n)
+}